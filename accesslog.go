@@ -0,0 +1,245 @@
+package cs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat 访问日志写入 Output 时的格式
+type AccessLogFormat int
+
+const (
+	// AccessLogText 文本格式，每行为 key=value 字段
+	AccessLogText AccessLogFormat = iota
+	// AccessLogJSON JSON Lines 格式，每行一个 JSON 对象
+	AccessLogJSON
+)
+
+// 脱敏后的字段值
+const redactedValue = "***"
+
+// AccessLogRedact 消息内容的脱敏规则
+type AccessLogRedact struct {
+	Cmd    string   // 命令，支持和路由一样的模式，如 user.*，为空时匹配所有命令
+	Fields []string // 需要脱敏的字段名，请求和响应的数据中任意层级的同名字段都会被替换为 ***，数据不是 JSON 时整个替换为 ***
+}
+
+// AccessLogConfig 访问日志中间件的配置
+type AccessLogConfig struct {
+	Logger Logger // 输出日志的实例，默认使用 Srv 的日志，设置了 Output 时无效
+	// Output 直接按 Format 格式把每条访问日志作为一行写入 Output，不经过 Logger
+	Output     io.Writer
+	Format     AccessLogFormat   // 写入 Output 的格式，默认为文本格式
+	Skip       []string          // 不记录的命令，支持和路由一样的模式，内置命令需要写完整的命令，如 cs.CmdHeartbeat
+	Payload    bool              // 是否记录请求和响应的数据
+	MaxPayload int               // 请求和响应的数据最多记录的字节数，超出的部分截断，默认为 0 不限制
+	Redact     []AccessLogRedact // 数据的脱敏规则，命令匹配到的所有规则的字段都会被脱敏
+	// Sample 响应码为 0 的请求的采样比例，取值 (0, 1)，默认为 0 记录全部，响应码不为 0 的请求总是记录
+	Sample float64
+}
+
+// AccessLog 访问日志中间件，每个请求在处理完成后记录一条日志
+// 包含会话、命令、响应码、处理耗时、请求和响应数据的字节数、适配器类型、远程地址和 trace id
+// 响应码为 0 时为 INFO 级别，否则为 WARN 级别，没有注册路由的内置命令不记录
+// srv.Use(cs.AccessLog(cs.AccessLogConfig{Output: os.Stdout, Format: cs.AccessLogJSON, Skip: []string{cs.CmdHeartbeat}}))
+func AccessLog(conf AccessLogConfig) HandlerFunc {
+	skip := newRouter()
+	for _, cmd := range conf.Skip {
+		skip.add(cmd, &registration{})
+	}
+	// 每个规则单独匹配，命令匹配到的所有规则的字段都需要脱敏
+	var redacts []redactRule
+	for _, rule := range conf.Redact {
+		r := redactRule{fields: map[string]bool{}}
+		if rule.Cmd != "" {
+			r.cmd = newRouter()
+			r.cmd.add(rule.Cmd, &registration{})
+		}
+		for _, f := range rule.Fields {
+			r.fields[f] = true
+		}
+		redacts = append(redacts, r)
+	}
+	l := &accessLogger{conf: conf}
+
+	return func(c *Context) {
+		if isInternalCmd(c.Cmd) && len(c.handlers) == len(c.Srv.middleware) {
+			c.Next()
+			return
+		}
+		if rt, _ := skip.match(c.Cmd); rt != nil {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		c.Next()
+		duration := time.Since(start)
+
+		if conf.Sample > 0 && conf.Sample < 1 && c.Code == 0 && rand.Float64() >= conf.Sample {
+			return
+		}
+		fields := map[string]bool{}
+		for _, r := range redacts {
+			if r.matches(c.Cmd) {
+				for f := range r.fields {
+					fields[f] = true
+				}
+			}
+		}
+		reqData := c.RawData
+		var respData []byte
+		if c.Data != nil {
+			respData = []byte(getLogDataString(c.Data))
+		}
+		adapter := ""
+		if c.Server != nil {
+			adapter = adapterName(c.Server)
+		}
+
+		kv := []interface{}{
+			"sid", c.SID,
+			"cmd", c.Cmd,
+			"seqno", c.Seqno,
+			"code", c.Code,
+			"duration_ms", float64(duration.Microseconds()) / 1000,
+			"req_size", len(reqData),
+			"resp_size", len(respData),
+			"adapter", adapter,
+		}
+		if addr := c.RemoteAddr(); addr != "" {
+			kv = append(kv, "remote", addr)
+		}
+		if id := c.TraceID(); id != "" {
+			kv = append(kv, "trace", id)
+		}
+		if c.Code != 0 && c.Msg != "" {
+			kv = append(kv, "msg", c.Msg)
+		}
+		if conf.Payload {
+			kv = append(kv,
+				"req", l.payload(reqData, fields),
+				"resp", l.payload(respData, fields),
+			)
+		}
+		level := LevelInfo
+		if c.Code != 0 {
+			level = LevelWarn
+		}
+		l.log(c, level, kv)
+	}
+}
+
+// 脱敏规则，cmd 为空时匹配所有命令
+type redactRule struct {
+	cmd    *router
+	fields map[string]bool
+}
+
+func (r redactRule) matches(cmd string) bool {
+	if r.cmd == nil {
+		return true
+	}
+	rt, _ := r.cmd.match(cmd)
+	return rt != nil
+}
+
+type accessLogger struct {
+	conf AccessLogConfig
+	mu   sync.Mutex // 保护 Output 的写入
+}
+
+// 输出一条访问日志
+func (l *accessLogger) log(c *Context, level LogLevel, kv []interface{}) {
+	if l.conf.Output == nil {
+		logger := l.conf.Logger
+		if logger == nil {
+			logger = c.Srv.Logger()
+		}
+		logger.Log(level, "access", kv...)
+		return
+	}
+
+	var b bytes.Buffer
+	now := time.Now()
+	if l.conf.Format == AccessLogJSON {
+		b.WriteString(`{"time":`)
+		writeJSON(&b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, level.String())
+		for i := 0; i+1 < len(kv); i += 2 {
+			b.WriteByte(',')
+			writeJSON(&b, kv[i])
+			b.WriteByte(':')
+			writeJSON(&b, kv[i+1])
+		}
+		b.WriteByte('}')
+	} else {
+		b.WriteString(now.Format("2006/01/02 15:04:05"))
+		b.WriteByte(' ')
+		b.WriteString(level.String())
+		b.WriteString(" access")
+		for i := 0; i+1 < len(kv); i += 2 {
+			b.WriteByte(' ')
+			b.WriteString(kv[i].(string))
+			b.WriteByte('=')
+			b.WriteString(logValue(kv[i+1]))
+		}
+	}
+	b.WriteByte('\n')
+	l.mu.Lock()
+	l.conf.Output.Write(b.Bytes())
+	l.mu.Unlock()
+}
+
+// 日志中记录的数据，先脱敏再截断，需要脱敏但不是 JSON 的数据整个记为 ***
+func (l *accessLogger) payload(data []byte, fields map[string]bool) string {
+	if len(fields) > 0 && len(data) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return redactedValue
+		}
+		if redactValue(v, fields) {
+			data, _ = json.Marshal(v)
+		}
+	}
+	if l.conf.MaxPayload > 0 && len(data) > l.conf.MaxPayload {
+		return string(data[:l.conf.MaxPayload]) + "...(" + strconv.Itoa(len(data)) + " bytes)"
+	}
+	return string(data)
+}
+
+// 把 v 中任意层级的字段替换为 ***，返回是否有字段被替换
+func redactValue(v interface{}, fields map[string]bool) bool {
+	changed := false
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range val {
+			if fields[k] {
+				val[k] = redactedValue
+				changed = true
+			} else if redactValue(sub, fields) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, sub := range val {
+			if redactValue(sub, fields) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	bt, err := json.Marshal(v)
+	if err != nil {
+		bt, _ = json.Marshal(getLogDataString(v))
+	}
+	b.Write(bt)
+}
@@ -0,0 +1,114 @@
+package cs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+func TestAccessLog(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		buf := bytes.NewBuffer(nil)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.Use(cs.AccessLog(cs.AccessLogConfig{
+			Output:     buf,
+			Format:     cs.AccessLogJSON,
+			Skip:       []string{"noisy.*"},
+			Payload:    true,
+			MaxPayload: 40,
+			Redact: []cs.AccessLogRedact{
+				{Cmd: "user.*", Fields: []string{"password"}},
+				{Cmd: "user.login", Fields: []string{"otp"}},
+				{Cmd: "raw", Fields: []string{"secret"}},
+			},
+		}))
+		srv.Handle("user.login", func(c *cs.Context) {
+			c.OK(map[string]interface{}{"token": strings.Repeat("x", 50)})
+		})
+		srv.Handle("raw", func(c *cs.Context) {
+			c.OK()
+		})
+		srv.Handle("noisy.ping", func(c *cs.Context) {
+			c.OK()
+		})
+		srv.Handle("fail", func(c *cs.Context) {
+			c.Resp(10, "failed")
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "noisy.ping"}
+		<-server.written
+		server.receive <- &cs.Request{Cmd: "user.login", Seqno: "1", RawData: []byte(`{"otp":"1234","password":"secret"}`)}
+		<-server.written
+		server.receive <- &cs.Request{Cmd: "fail"}
+		<-server.written
+		server.receive <- &cs.Request{Cmd: "raw", RawData: []byte(`secret=1`)}
+		<-server.written
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		t.Assert(len(lines), 3)
+		entry := map[string]interface{}{}
+		t.Assert(json.Unmarshal([]byte(lines[0]), &entry), nil)
+		t.Assert(entry["level"], "INFO")
+		t.Assert(entry["cmd"], "user.login")
+		t.Assert(entry["seqno"], "1")
+		t.Assert(entry["code"], 0)
+		t.Assert(entry["req_size"], 34)
+		t.Assert(entry["resp_size"], 62)
+		t.Assert(entry["adapter"], "cs_test.chanAdapter")
+		t.Assert(entry["req"], `{"otp":"***","password":"***"}`)
+		t.Assert(entry["resp"], `{"token":"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxx...(62 bytes)`)
+		_, ok := entry["duration_ms"].(float64)
+		t.Assert(ok, true)
+
+		entry = map[string]interface{}{}
+		t.Assert(json.Unmarshal([]byte(lines[1]), &entry), nil)
+		t.Assert(entry["level"], "WARN")
+		t.Assert(entry["cmd"], "fail")
+		t.Assert(entry["code"], 10)
+
+		// 需要脱敏但不是 JSON 的数据不记录原文
+		entry = map[string]interface{}{}
+		t.Assert(json.Unmarshal([]byte(lines[2]), &entry), nil)
+		t.Assert(entry["req"], "***")
+	})
+}
+
+func TestAccessLog_Sample(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		logger := &captureLogger{}
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.Use(cs.AccessLog(cs.AccessLogConfig{Logger: logger, Sample: 1e-9}))
+		srv.Handle("ok", func(c *cs.Context) {
+			c.OK()
+		})
+		srv.Handle("fail", func(c *cs.Context) {
+			c.Resp(10, "failed")
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "ok"}
+		<-server.written
+		server.receive <- &cs.Request{Cmd: "fail"}
+		<-server.written
+
+		entry := logger.find("access")
+		t.AssertNE(entry, nil)
+		t.Assert(entry.level, cs.LevelWarn)
+		t.Assert(entry.kv[:4], []interface{}{"sid", "1", "cmd", "fail"})
+		t.Assert(len(logger.entries), 1)
+	})
+}
@@ -0,0 +1,234 @@
+package cs
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Credentials 会话建立时适配器提供的认证信息
+type Credentials struct {
+	Header     http.Header // websocket 升级请求或者 HTTP 请求的请求头，包括 Cookie
+	Query      url.Values  // websocket 升级请求或者 HTTP 请求的查询参数
+	Payload    []byte      // tcp 连接的第一个数据包
+	RemoteAddr string      // 远程地址
+}
+
+// Cookie 获取请求头中指定名称的 Cookie 值，不存在时返回空字符串
+func (c *Credentials) Cookie(name string) string {
+	req := http.Request{Header: c.Header}
+	if cookie, err := req.Cookie(name); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// CredentialsAdapter 可选接口，适配器实现该接口后可以给 OnAuthenticate 提供会话的认证信息
+type CredentialsAdapter interface {
+	// Credentials 会话的认证信息，会话不存在时返回 nil
+	Credentials(sid string) *Credentials
+}
+
+// Auth 会话认证的上下文，OnAuthenticate 的参数
+type Auth struct {
+	SID         string
+	Server      ServerAdapter
+	Credentials *Credentials
+	ctx         context.Context
+	srv         *Srv
+	identity    interface{}
+	authed      bool
+	requireCmd  string
+	requireTime time.Duration
+}
+
+// Context 当前认证的 context.Context
+func (a *Auth) Context() context.Context {
+	return a.ctx
+}
+
+// SetIdentity 认证通过，给会话设置身份信息，之后可以通过 c.Identity() 获取
+func (a *Auth) SetIdentity(identity interface{}) {
+	a.identity = identity
+	a.authed = true
+}
+
+// BindUser 认证通过，并将会话绑定到用户 uid
+func (a *Auth) BindUser(uid string) {
+	a.srv.BindUser(a.SID, uid)
+	a.authed = true
+}
+
+// Require 暂不认证，要求客户端在 timeout 内发送 cmd 命令进行认证，超时后关闭会话
+// 在此之前其他命令都会响应 CodeUnauthorized，cmd 的处理函数认证通过后应调用 c.SetIdentity
+func (a *Auth) Require(cmd string, timeout time.Duration) {
+	a.requireCmd = cmd
+	a.requireTime = timeout
+}
+
+// 会话的认证状态
+type authState struct {
+	ready      chan struct{} // 认证函数执行完成后关闭
+	mu         sync.Mutex
+	err        error // 认证失败的错误
+	authed     bool
+	identity   interface{}
+	requireCmd string
+	timer      *time.Timer
+}
+
+// OnAuthenticate 设置会话的认证函数，在会话的 CmdConnected 处理函数执行之前调用
+// 没有 CmdConnected 消息的适配器会在会话的第一个命令之前调用，认证完成之前会话的其他命令会等待
+// 认证函数返回错误时拒绝会话，其他命令响应 CodeUnauthorized 并关闭会话
+// 返回 nil 并且没有调用 a.Require 时认证通过
+// srv.OnAuthenticate(func(a *cs.Auth) error {
+// uid, err := checkToken(a.Credentials.Query.Get("token"))
+// if err == nil { a.BindUser(uid) }
+// return err
+// })
+func (s *Srv) OnAuthenticate(f func(a *Auth) error) *Srv {
+	s.authHandler = f
+	return s
+}
+
+// 会话关闭时清理认证状态
+func (s *Srv) removeAuthState(sid string) {
+	if val, ok := s.authStates.LoadAndDelete(sid); ok {
+		st := val.(*authState)
+		st.mu.Lock()
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+		st.mu.Unlock()
+	}
+}
+
+// Identity 获取会话 sid 的身份信息
+func (s *Srv) Identity(sid string) interface{} {
+	if val, ok := s.authStates.Load(sid); ok {
+		st := val.(*authState)
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.identity
+	}
+	return nil
+}
+
+// Identity 获取当前会话的身份信息
+func (c *Context) Identity() interface{} {
+	return c.Srv.Identity(c.SID)
+}
+
+// SetIdentity 当前会话认证通过，并设置身份信息，一般在 Auth.Require 指定的认证命令中调用
+func (c *Context) SetIdentity(identity interface{}) {
+	val, _ := c.Srv.authStates.LoadOrStore(c.SID, newAuthState(true))
+	st := val.(*authState)
+	st.mu.Lock()
+	st.authed = true
+	st.identity = identity
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	st.mu.Unlock()
+}
+
+// WithCredentials 设置本次请求的认证信息，优先于适配器通过 CredentialsAdapter 提供的会话认证信息
+// 适配器直接调用 CallContext 处理请求时使用，如 HTTP 的命令请求，同一个会话并发的请求不会互相影响
+func (c *Context) WithCredentials(cred *Credentials) *Context {
+	c.cred = cred
+	return c
+}
+
+// 本次请求的认证信息，没有设置时使用适配器提供的会话认证信息
+func (c *Context) credentials() *Credentials {
+	if c.cred != nil {
+		return c.cred
+	}
+	if adapter, ok := c.Server.(CredentialsAdapter); ok {
+		return adapter.Credentials(c.SID)
+	}
+	return nil
+}
+
+func newAuthState(ready bool) *authState {
+	st := &authState{ready: make(chan struct{})}
+	if ready {
+		close(st.ready)
+	}
+	return st
+}
+
+// 检查会话是否可以执行当前命令，会话的第一个消息会执行认证函数
+func (s *Srv) authorize(ctx *Context) bool {
+	if s.authHandler == nil || ctx.Cmd == CmdClosed || ctx.Cmd == CmdHeartbeat {
+		return true
+	}
+	val, loaded := s.authStates.LoadOrStore(ctx.SID, newAuthState(false))
+	st := val.(*authState)
+	if !loaded {
+		s.authenticate(ctx, st)
+	}
+	select {
+	case <-st.ready:
+	case <-ctx.Context().Done():
+		ctx.Resp(CodeUnauthorized, msgUnauthorized)
+		return false
+	}
+
+	st.mu.Lock()
+	err, authed, requireCmd := st.err, st.authed, st.requireCmd
+	st.mu.Unlock()
+	switch {
+	case err != nil:
+		ctx.Resp(CodeUnauthorized, err.Error())
+		return false
+	case authed || ctx.Cmd == CmdConnected || ctx.Cmd == requireCmd:
+		return true
+	}
+	ctx.Resp(CodeUnauthorized, msgUnauthorized)
+	return false
+}
+
+// 执行认证函数
+func (s *Srv) authenticate(ctx *Context, st *authState) {
+	defer close(st.ready)
+	a := &Auth{
+		SID:         ctx.SID,
+		Server:      ctx.Server,
+		Credentials: ctx.credentials(),
+		ctx:         ctx.Context(),
+		srv:         s,
+	}
+	if a.Credentials == nil {
+		a.Credentials = &Credentials{Header: http.Header{}, Query: url.Values{}}
+	}
+	err := s.authHandler(a)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err != nil {
+		st.err = err
+		s.logger.Log(LevelInfo, "authentication failed", "sid", ctx.SID, "error", err)
+		go s.closeWithReason(ctx.Server, ctx.SID, CloseReasonUnauthorized)
+		return
+	}
+	st.identity = a.identity
+	if a.requireCmd == "" {
+		st.authed = true
+		return
+	}
+	st.authed = a.authed
+	st.requireCmd = a.requireCmd
+	if !st.authed && a.requireTime > 0 {
+		st.timer = time.AfterFunc(a.requireTime, func() {
+			st.mu.Lock()
+			authed := st.authed
+			st.mu.Unlock()
+			if !authed {
+				s.closeWithReason(ctx.Server, ctx.SID, CloseReasonUnauthorized)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package cs_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+func TestSrv_Authenticate(t *testing.T) {
+	newSrv := func(f func(a *cs.Auth) error) (*cs.Srv, *chanAdapter) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.OnAuthenticate(f)
+		srv.Handle("auth", func(c *cs.Context) {
+			c.SetIdentity(c.RawData)
+			c.OK()
+		})
+		srv.Handle("ping", func(c *cs.Context) {
+			c.OK(c.Identity())
+		})
+		go srv.Run()
+		return srv, server
+	}
+
+	// 认证失败，拒绝请求并关闭会话
+	gtest.C(t, func(t *gtest.T) {
+		srv, server := newSrv(func(a *cs.Auth) error {
+			if a.Credentials.Query.Get("token") != "ok" {
+				return errors.New("invalid token")
+			}
+			return nil
+		})
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "ping"}
+		resp := <-server.written
+		t.Assert(resp.Code, cs.CodeUnauthorized)
+		t.Assert(resp.Msg, "invalid token")
+		time.Sleep(10 * time.Millisecond)
+		t.Assert(server.GetAllSID(), []string{})
+	})
+
+	// 通过认证命令认证
+	gtest.C(t, func(t *gtest.T) {
+		srv, server := newSrv(func(a *cs.Auth) error {
+			a.Require("auth", time.Second)
+			return nil
+		})
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "ping"}
+		t.Assert((<-server.written).Code, cs.CodeUnauthorized)
+		server.receive <- &cs.Request{Cmd: "auth", RawData: []byte(`"u1"`)}
+		t.Assert((<-server.written).Code, 0)
+		server.receive <- &cs.Request{Cmd: "ping"}
+		resp := <-server.written
+		t.Assert(resp.Code, 0)
+		t.Assert(resp.Data, []byte(`"u1"`))
+		t.Assert(srv.Identity("1"), []byte(`"u1"`))
+	})
+
+	// 超时没有认证，关闭会话
+	gtest.C(t, func(t *gtest.T) {
+		srv, server := newSrv(func(a *cs.Auth) error {
+			a.Require("auth", 20*time.Millisecond)
+			return nil
+		})
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "ping"}
+		t.Assert((<-server.written).Code, cs.CodeUnauthorized)
+		time.Sleep(50 * time.Millisecond)
+		t.Assert(server.GetAllSID(), []string{})
+	})
+}
+
+func TestSrv_AuthenticateOnConnect(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		authed := make(chan bool, 1)
+		connected := make(chan bool, 1)
+		srv.OnAuthenticate(func(a *cs.Auth) error {
+			authed <- true
+			if a.Credentials.Query.Get("token") != "ok" {
+				return errors.New("invalid token")
+			}
+			return nil
+		})
+		srv.OnConnect(func(sid string, s cs.ServerAdapter) {
+			connected <- true
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		// 认证失败的会话不触发 OnConnect
+		server.receive <- &cs.Request{Cmd: cs.CmdConnected}
+		t.Assert(<-authed, true)
+		select {
+		case <-connected:
+			t.Error("OnConnect called before authentication succeeded")
+		case <-time.After(20 * time.Millisecond):
+		}
+	})
+}
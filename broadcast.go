@@ -0,0 +1,112 @@
+package cs
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// 广播时默认同时推送的会话数量
+const defaultBroadcastLimit = 64
+
+// BroadcastResult 广播的结果
+type BroadcastResult struct {
+	Delivered []string         // 推送成功的会话 SID
+	Failed    map[string]error // 推送失败的会话 SID 和错误
+}
+
+// SetBroadcastLimit 设置广播时同时推送的会话数量，默认为 64
+func (s *Srv) SetBroadcastLimit(n int) *Srv {
+	if n <= 0 {
+		n = defaultBroadcastLimit
+	}
+	s.broadcastLimit = n
+	return s
+}
+
+// Broadcast 往所有可用的会话推送消息，消息会经过推送中间件
+// 每个会话只会通过所属的适配器收到一次消息，会阻塞直到所有的会话都推送完成，不需要结果时使用 BroadcastAsync
+func (s *Srv) Broadcast(resp *Response) *BroadcastResult {
+	return s.broadcast(nil, nil, resp)
+}
+
+// BroadcastAsync 在新的 goroutine 中广播消息，不等待推送完成
+func (s *Srv) BroadcastAsync(resp *Response) {
+	go s.broadcast(nil, nil, resp)
+}
+
+// BroadcastFilter 给 filter 返回 true 的会话推送消息
+// srv.BroadcastFilter(func(sid string) bool { return srv.UserID(sid) != "" }, resp)
+func (s *Srv) BroadcastFilter(filter func(sid string) bool, resp *Response) *BroadcastResult {
+	return s.broadcast(nil, filter, resp)
+}
+
+// 广播的目标会话
+type broadcastTarget struct {
+	server ServerAdapter
+	sid    string
+}
+
+// 广播消息，c 为空时以接收者的会话执行推送中间件
+// 目标会话从会话注册表中获取，注册表中没有会话的适配器(如不产生 CmdConnected 的适配器)遍历它的所有 SID
+func (s *Srv) broadcast(c *Context, filter func(sid string) bool, resp *Response) *BroadcastResult {
+	targets := []broadcastTarget{}
+	seen := map[string]struct{}{}
+	registered := map[ServerAdapter]bool{}
+	s.RangeSession(func(sid string, server ServerAdapter) bool {
+		registered[server] = true
+		seen[sid] = struct{}{}
+		if filter == nil || filter(sid) {
+			targets = append(targets, broadcastTarget{server, sid})
+		}
+		return true
+	})
+	for _, server := range s.Server {
+		if registered[server] {
+			continue
+		}
+		for _, sid := range server.GetAllSID() {
+			if _, ok := seen[sid]; ok {
+				continue
+			}
+			seen[sid] = struct{}{}
+			if filter != nil && !filter(sid) {
+				continue
+			}
+			targets = append(targets, broadcastTarget{server, sid})
+		}
+	}
+	return s.fanout(c, targets, resp)
+}
+
+// 并发给目标会话推送消息，同时推送的数量不超过 broadcastLimit
+func (s *Srv) fanout(c *Context, targets []broadcastTarget, resp *Response) *BroadcastResult {
+	result := &BroadcastResult{Delivered: []string{}, Failed: map[string]error{}}
+	span := s.startSpan(c.spanContext(), "cs.broadcast", "cmd", resp.Cmd, "targets", strconv.Itoa(len(targets)))
+	defer span.End()
+	parent := span.Context()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, s.broadcastLimit)
+	for _, t := range targets {
+		limit <- struct{}{}
+		wg.Add(1)
+		go func(t broadcastTarget) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			err := s.pushServer(c, parent, t.server, t.sid, resp)
+			mu.Lock()
+			if err != nil {
+				result.Failed[t.sid] = err
+			} else {
+				result.Delivered = append(result.Delivered, t.sid)
+			}
+			mu.Unlock()
+		}(t)
+	}
+	wg.Wait()
+	sort.Strings(result.Delivered)
+	return result
+}
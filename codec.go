@@ -0,0 +1,278 @@
+package cs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Codec 消息编解码器，适配器使用它在消息与字节数据之间转换
+// 消息的结构为 {"cmd": "", "seqno": "", "code": 0, "msg": "", "data": {}, "trace": ""}，请求消息没有 code 和 msg，trace 是可选的
+type Codec interface {
+	// Name 编解码器名称，如 json, msgpack, cbor，用于 websocket 子协议等场景的协商
+	Name() string
+	// Marshal 将响应消息编码为字节数据
+	Marshal(resp *Response) ([]byte, error)
+	// Unmarshal 将字节数据解码为请求消息，请求数据 RawData 统一转换为 json 格式，以便使用 Context.Parse 解析
+	Unmarshal(data []byte, req *Request) error
+}
+
+// 内置的编解码器
+var (
+	JSONCodec    Codec = jsonCodec{}    // JSON，默认的编解码器
+	MsgpackCodec Codec = msgpackCodec{} // MessagePack
+	CBORCodec    Codec = cborCodec{}    // CBOR
+)
+
+var (
+	codecs   = map[string]Codec{}
+	codecsMu sync.RWMutex
+)
+
+func init() {
+	RegisterCodec(JSONCodec)
+	RegisterCodec(MsgpackCodec)
+	RegisterCodec(CBORCodec)
+}
+
+// RegisterCodec 注册编解码器，注册后可以被适配器按名称协商使用，同名的会被覆盖
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	codecs[c.Name()] = c
+	codecsMu.Unlock()
+}
+
+// GetCodec 根据名称获取已注册的编解码器，不存在时返回 nil
+func GetCodec(name string) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[name]
+}
+
+// DetectCodec 根据消息的第一个字节识别内置的编解码器，无法识别时返回 nil
+// 请求消息是一个 map，JSON 以 { 开头，MessagePack 为 map 类型(0x80-0x8f, 0xde, 0xdf)，CBOR 为 map 类型(0xa0-0xbf)或者自描述标签
+func DetectCodec(data []byte) Codec {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) == 0 {
+		return nil
+	}
+	b := data[0]
+	switch {
+	case b == '{':
+		return JSONCodec
+	case b >= 0x80 && b <= 0x8f, b == 0xde, b == 0xdf:
+		return MsgpackCodec
+	case b >= 0xa0 && b <= 0xbf:
+		return CBORCodec
+	case len(data) >= 3 && b == 0xd9 && data[1] == 0xd9 && data[2] == 0xf7:
+		return CBORCodec
+	}
+	return nil
+}
+
+// 消息在传输时的 json 结构
+type requestData struct {
+	Cmd   string          `json:"cmd"`   // message command, use for route
+	Seqno string          `json:"seqno"` // seq number,the request id
+	Data  json.RawMessage `json:"data"`  // request data
+	Trace string          `json:"trace"` // trace context
+}
+
+type responseData struct {
+	Cmd   string      `json:"cmd"`             // message command, use for route
+	Seqno string      `json:"seqno"`           // seq number,the request id
+	Code  int         `json:"code"`            // response status code
+	Msg   string      `json:"msg"`             // response status message text
+	Data  interface{} `json:"data"`            // response data
+	Trace string      `json:"trace,omitempty"` // trace context
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(resp *Response) ([]byte, error) {
+	return json.Marshal(&responseData{
+		Cmd:   resp.Cmd,
+		Seqno: resp.Seqno,
+		Code:  resp.Code,
+		Msg:   resp.Msg,
+		Data:  resp.Data,
+		Trace: resp.Trace,
+	})
+}
+
+func (jsonCodec) Unmarshal(data []byte, req *Request) error {
+	r := &requestData{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return err
+	}
+	req.Cmd = r.Cmd
+	req.Seqno = r.Seqno
+	req.RawData = r.Data
+	req.Trace = r.Trace
+	return nil
+}
+
+// 二进制编解码器的通用实现
+// 消息先转换为 json 的通用结构，即 nil, bool, json.Number, string, []interface{}, map[string]interface{}，再进行编码
+// 这样响应数据的 json tag 等规则和 JSON 编解码器保持一致
+
+// 二进制编码器
+type valueEncoder interface {
+	encodeNil()
+	encodeBool(bool)
+	encodeInt(int64)
+	encodeUint(uint64)
+	encodeFloat(float64)
+	encodeString(string)
+	encodeArrayHead(int)
+	encodeMapHead(int)
+	bytes() []byte
+}
+
+// 将响应消息编码为二进制
+func marshalResponse(enc valueEncoder, resp *Response) ([]byte, error) {
+	data, err := toGeneric(resp.Data)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Trace != "" {
+		enc.encodeMapHead(6)
+		enc.encodeString("trace")
+		enc.encodeString(resp.Trace)
+	} else {
+		enc.encodeMapHead(5)
+	}
+	enc.encodeString("cmd")
+	enc.encodeString(resp.Cmd)
+	enc.encodeString("seqno")
+	enc.encodeString(resp.Seqno)
+	enc.encodeString("code")
+	enc.encodeInt(int64(resp.Code))
+	enc.encodeString("msg")
+	enc.encodeString(resp.Msg)
+	enc.encodeString("data")
+	if err := encodeValue(enc, data); err != nil {
+		return nil, err
+	}
+	return enc.bytes(), nil
+}
+
+// 将二进制解码后的通用结构转换为请求消息
+func unmarshalRequest(v interface{}, req *Request) error {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return errors.New("cs: request message must be a map")
+	}
+	cmd, _ := m["cmd"].(string)
+	seqno, _ := m["seqno"].(string)
+	trace, _ := m["trace"].(string)
+	req.Cmd = cmd
+	req.Seqno = seqno
+	req.Trace = trace
+	req.RawData = nil
+	if data, ok := m["data"]; ok {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		req.RawData = raw
+	}
+	return nil
+}
+
+// 转换为 json 的通用结构
+func toGeneric(v interface{}) (interface{}, error) {
+	switch v.(type) {
+	case nil, bool, string, json.Number:
+		return v, nil
+	}
+	bt, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(bt))
+	dec.UseNumber()
+	var g interface{}
+	if err := dec.Decode(&g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func encodeValue(enc valueEncoder, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		enc.encodeNil()
+	case bool:
+		enc.encodeBool(val)
+	case string:
+		enc.encodeString(val)
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			enc.encodeInt(i)
+		} else if u, err := strconv.ParseUint(string(val), 10, 64); err == nil {
+			enc.encodeUint(u)
+		} else if f, err := val.Float64(); err == nil {
+			enc.encodeFloat(f)
+		} else {
+			return err
+		}
+	case []interface{}:
+		enc.encodeArrayHead(len(val))
+		for _, item := range val {
+			if err := encodeValue(enc, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		enc.encodeMapHead(len(val))
+		for _, k := range keys {
+			enc.encodeString(k)
+			if err := encodeValue(enc, val[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cs: unsupported value type %T", v)
+	}
+	return nil
+}
+
+// 二进制解码出的 map key 统一转换为字符串
+func mapKey(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	if b, ok := k.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(k)
+}
+
+// 以大端序追加 n 字节的无符号整数
+func appendUint(buf []byte, u uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		buf = append(buf, byte(u>>(8*uint(i))))
+	}
+	return buf
+}
+
+var errShortData = errors.New("cs: unexpected end of data")
+
+// 二进制编解码器解码时数组、对象和标签最多嵌套的层数，避免恶意的消息导致栈溢出
+const maxDecodeDepth = 100
+
+var errTooDeep = errors.New("cs: message nested too deep")
@@ -0,0 +1,287 @@
+package cs
+
+import (
+	"fmt"
+	"math"
+)
+
+// CBOR 编解码器，规范参考 RFC 8949
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) Marshal(resp *Response) ([]byte, error) {
+	return marshalResponse(&cborEncoder{}, resp)
+}
+
+func (cborCodec) Unmarshal(data []byte, req *Request) error {
+	d := &cborDecoder{buf: data}
+	v, err := d.decode()
+	if err != nil {
+		return err
+	}
+	return unmarshalRequest(v, req)
+}
+
+// CBOR 的主类型
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// 不定长数据的附加信息和结束符
+const (
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+type cborEncoder struct {
+	buf []byte
+}
+
+func (e *cborEncoder) bytes() []byte {
+	return e.buf
+}
+
+// 写入主类型和参数
+func (e *cborEncoder) head(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = appendUint(append(e.buf, major|25), n, 2)
+	case n <= math.MaxUint32:
+		e.buf = appendUint(append(e.buf, major|26), n, 4)
+	default:
+		e.buf = appendUint(append(e.buf, major|27), n, 8)
+	}
+}
+
+func (e *cborEncoder) encodeNil() {
+	e.buf = append(e.buf, 0xf6)
+}
+
+func (e *cborEncoder) encodeBool(b bool) {
+	if b {
+		e.buf = append(e.buf, 0xf5)
+	} else {
+		e.buf = append(e.buf, 0xf4)
+	}
+}
+
+func (e *cborEncoder) encodeInt(i int64) {
+	if i >= 0 {
+		e.head(cborUint, uint64(i))
+	} else {
+		e.head(cborNegInt, uint64(-1-i))
+	}
+}
+
+func (e *cborEncoder) encodeUint(u uint64) {
+	e.head(cborUint, u)
+}
+
+func (e *cborEncoder) encodeFloat(f float64) {
+	e.buf = appendUint(append(e.buf, 0xfb), math.Float64bits(f), 8)
+}
+
+func (e *cborEncoder) encodeString(s string) {
+	e.head(cborText, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *cborEncoder) encodeArrayHead(n int) {
+	e.head(cborArray, uint64(n))
+}
+
+func (e *cborEncoder) encodeMapHead(n int) {
+	e.head(cborMap, uint64(n))
+}
+
+type cborDecoder struct {
+	buf   []byte
+	pos   int
+	depth int // 当前的嵌套层数
+}
+
+func (d *cborDecoder) read(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return nil, errShortData
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// 读取数据项的头部，返回主类型，附加信息和参数
+func (d *cborDecoder) head() (byte, byte, uint64, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	if info < 24 || info == cborIndefinite {
+		return major, info, uint64(info), nil
+	}
+	if info > 27 {
+		return 0, 0, 0, fmt.Errorf("cs: invalid cbor additional info %d", info)
+	}
+	bt, err := d.read(1 << (info - 24))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var n uint64
+	for _, c := range bt {
+		n = n<<8 | uint64(c)
+	}
+	return major, info, n, nil
+}
+
+// 下一个字节是否是不定长数据的结束符，是则跳过
+func (d *cborDecoder) isBreak() bool {
+	if d.pos < len(d.buf) && d.buf[d.pos] == cborBreak {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *cborDecoder) decode() (interface{}, error) {
+	if d.depth >= maxDecodeDepth {
+		return nil, errTooDeep
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == cborIndefinite
+	switch major {
+	case cborUint:
+		return n, nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return -1 - float64(n), nil
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		var bt []byte
+		if indefinite {
+			for !d.isBreak() {
+				chunk, err := d.decode()
+				if err != nil {
+					return nil, err
+				}
+				switch c := chunk.(type) {
+				case string:
+					bt = append(bt, c...)
+				case []byte:
+					bt = append(bt, c...)
+				default:
+					return nil, fmt.Errorf("cs: invalid cbor string chunk %T", chunk)
+				}
+			}
+		} else {
+			b, err := d.read(int(n))
+			if err != nil {
+				return nil, err
+			}
+			bt = append([]byte{}, b...)
+		}
+		if major == cborText {
+			return string(bt), nil
+		}
+		return bt, nil
+	case cborArray:
+		if !indefinite && n > uint64(len(d.buf)-d.pos) {
+			return nil, errShortData
+		}
+		arr := []interface{}{}
+		for i := uint64(0); indefinite || i < n; i++ {
+			if indefinite && d.isBreak() {
+				break
+			}
+			v, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case cborMap:
+		if !indefinite && n > uint64(len(d.buf)-d.pos) {
+			return nil, errShortData
+		}
+		m := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < n; i++ {
+			if indefinite && d.isBreak() {
+				break
+			}
+			k, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			m[mapKey(k)] = v
+		}
+		return m, nil
+	case cborTag:
+		// 忽略标签，直接使用标签的内容
+		return d.decode()
+	}
+
+	// cborSimple
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return halfToFloat(uint16(n)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 27:
+		return math.Float64frombits(n), nil
+	}
+	return nil, fmt.Errorf("cs: unsupported cbor simple value %d", info)
+}
+
+// 半精度浮点数转换为 float64
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
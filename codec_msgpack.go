@@ -0,0 +1,284 @@
+package cs
+
+import (
+	"fmt"
+	"math"
+)
+
+// MessagePack 编解码器，规范参考 https://github.com/msgpack/msgpack/blob/master/spec.md
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(resp *Response) ([]byte, error) {
+	return marshalResponse(&msgpackEncoder{}, resp)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, req *Request) error {
+	d := &msgpackDecoder{buf: data}
+	v, err := d.decode()
+	if err != nil {
+		return err
+	}
+	return unmarshalRequest(v, req)
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) bytes() []byte {
+	return e.buf
+}
+
+func (e *msgpackEncoder) encodeNil() {
+	e.buf = append(e.buf, 0xc0)
+}
+
+func (e *msgpackEncoder) encodeBool(b bool) {
+	if b {
+		e.buf = append(e.buf, 0xc3)
+	} else {
+		e.buf = append(e.buf, 0xc2)
+	}
+}
+
+func (e *msgpackEncoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = appendUint(e.buf, uint64(uint16(i)), 2)
+	case i >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = appendUint(e.buf, uint64(uint32(i)), 4)
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = appendUint(e.buf, uint64(i), 8)
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		e.buf = append(e.buf, byte(u))
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.buf = appendUint(e.buf, uint64(uint16(u)), 2)
+	case u <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.buf = appendUint(e.buf, uint64(uint32(u)), 4)
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = appendUint(e.buf, u, 8)
+	}
+}
+
+func (e *msgpackEncoder) encodeFloat(f float64) {
+	e.buf = append(e.buf, 0xcb)
+	e.buf = appendUint(e.buf, math.Float64bits(f), 8)
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xda)
+		e.buf = appendUint(e.buf, uint64(uint16(n)), 2)
+	default:
+		e.buf = append(e.buf, 0xdb)
+		e.buf = appendUint(e.buf, uint64(uint32(n)), 4)
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeArrayHead(n int) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xdc)
+		e.buf = appendUint(e.buf, uint64(uint16(n)), 2)
+	default:
+		e.buf = append(e.buf, 0xdd)
+		e.buf = appendUint(e.buf, uint64(uint32(n)), 4)
+	}
+}
+
+func (e *msgpackEncoder) encodeMapHead(n int) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xde)
+		e.buf = appendUint(e.buf, uint64(uint16(n)), 2)
+	default:
+		e.buf = append(e.buf, 0xdf)
+		e.buf = appendUint(e.buf, uint64(uint32(n)), 4)
+	}
+}
+
+type msgpackDecoder struct {
+	buf   []byte
+	pos   int
+	depth int // 当前的嵌套层数
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return nil, errShortData
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// 读取 n 字节的大端无符号整数
+func (d *msgpackDecoder) readUint(n int) (uint64, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	if d.depth >= maxDecodeDepth {
+		return nil, errTooDeep
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	head, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	b := head[0]
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b >= 0x80 && b <= 0x8f:
+		return d.decodeMap(int(b & 0x0f))
+	case b >= 0x90 && b <= 0x9f:
+		return d.decodeArray(int(b & 0x0f))
+	case b >= 0xa0 && b <= 0xbf:
+		return d.decodeString(int(b & 0x1f))
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bt, err := d.read(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, bt...), nil
+	case 0xca:
+		u, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.readUint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.readUint(1 << (b - 0xcc))
+	case 0xd0:
+		u, err := d.readUint(1)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := d.readUint(2)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := d.readUint(4)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := d.readUint(8)
+		return int64(u), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n))
+	}
+	return nil, fmt.Errorf("cs: unsupported msgpack type 0x%x", b)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	if n > len(d.buf)-d.pos {
+		return nil, errShortData
+	}
+	arr := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	if n > len(d.buf)-d.pos {
+		return nil, errShortData
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		m[mapKey(k)] = v
+	}
+	return m, nil
+}
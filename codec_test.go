@@ -0,0 +1,77 @@
+package cs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+func TestCodec(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		for _, codec := range []cs.Codec{cs.JSONCodec, cs.MsgpackCodec, cs.CBORCodec} {
+			t.Assert(cs.GetCodec(codec.Name()), codec)
+			bt, err := codec.Marshal(&cs.Response{
+				Cmd:   "a",
+				Seqno: "1",
+				Code:  -300,
+				Msg:   "ok",
+				Data: map[string]interface{}{
+					"int":   70000,
+					"neg":   -5,
+					"float": 1.5,
+					"str":   "hello",
+					"bool":  true,
+					"null":  nil,
+					"list":  []interface{}{1, "2"},
+					"big":   uint64(1) << 63,
+				},
+			})
+			t.Assert(err, nil)
+			t.Assert(cs.DetectCodec(bt), codec)
+
+			// 响应消息也包含 cmd, seqno, data，可以按请求消息解码
+			req := &cs.Request{}
+			t.Assert(codec.Unmarshal(bt, req), nil)
+			t.Assert(req.Cmd, "a")
+			t.Assert(req.Seqno, "1")
+			t.Assert(string(req.RawData), `{"big":9223372036854775808,"bool":true,"float":1.5,"int":70000,"list":[1,"2"],"neg":-5,"null":null,"str":"hello"}`)
+
+			// 可选的 trace 字段
+			bt, err = codec.Marshal(&cs.Response{Cmd: "a", Trace: "t1-s1"})
+			t.Assert(err, nil)
+			t.Assert(codec.Unmarshal(bt, req), nil)
+			t.Assert(req.Trace, "t1-s1")
+		}
+
+		req := &cs.Request{}
+		msgpack := []byte("\x82\xa3cmd\xa1a\xa4data\x81\xa1x\x01")
+		t.Assert(cs.DetectCodec(msgpack), cs.MsgpackCodec)
+		t.Assert(cs.MsgpackCodec.Unmarshal(msgpack, req), nil)
+		t.Assert(req.Cmd, "a")
+		t.Assert(string(req.RawData), `{"x":1}`)
+
+		cbor := []byte("\xbf\x63cmd\x61a\x64data\xa1\x61x\xf9\x3e\x00\xff")
+		t.Assert(cs.DetectCodec(cbor), cs.CBORCodec)
+		t.Assert(cs.CBORCodec.Unmarshal(cbor, req), nil)
+		t.Assert(req.Cmd, "a")
+		t.Assert(string(req.RawData), `{"x":1.5}`)
+
+		t.AssertNE(cs.MsgpackCodec.Unmarshal([]byte("\x82\xa3cm"), req), nil)
+		t.AssertNE(cs.CBORCodec.Unmarshal([]byte("\x01"), req), nil)
+		t.Assert(cs.DetectCodec([]byte("xx")), nil)
+
+		// 嵌套过深的消息返回错误，不会栈溢出
+		deep := 1000
+		msgpack = append(append([]byte("\x81\xa4data"), bytes.Repeat([]byte{0x91}, deep)...), 0x01)
+		t.Assert(cs.MsgpackCodec.Unmarshal(msgpack, req).Error(), "cs: message nested too deep")
+		cbor = append(append([]byte("\xa1\x64data"), bytes.Repeat([]byte{0x81}, deep)...), 0x01)
+		t.Assert(cs.CBORCodec.Unmarshal(cbor, req).Error(), "cs: message nested too deep")
+		cbor = append(append([]byte("\xa1\x64data"), bytes.Repeat([]byte{0xc1}, deep)...), 0x01)
+		t.Assert(cs.CBORCodec.Unmarshal(cbor, req).Error(), "cs: message nested too deep")
+		// 限制以内的嵌套可以正常解码
+		cbor = append(append([]byte("\xa2\x63cmd\x61a\x64data"), bytes.Repeat([]byte{0x81}, 50)...), 0x01)
+		t.Assert(cs.CBORCodec.Unmarshal(cbor, req), nil)
+	})
+}
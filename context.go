@@ -7,7 +7,6 @@ import (
 	"reflect"
 
 	"github.com/gogf/gf/encoding/gjson"
-	"github.com/gogf/gf/util/gvalid"
 )
 
 // HandlerFunc 消息处理函数，中间件和路由的函数签名
@@ -24,6 +23,36 @@ type Context struct {
 	handlers     []HandlerFunc
 	handlerIndex int
 	handlerAbort bool
+	ctx          context.Context
+	cancel       context.CancelFunc
+	timeout      *timeoutState // 所在的 Timeout 中间件的超时设置
+	params       map[string]string
+	route        string       // 匹配到的路由
+	span         Span         // 当前请求的 span
+	panicked     bool         // 处理函数的 panic 已经通知过 OnPanic
+	connecting   bool         // 适配器产生的 CmdConnected 消息，认证通过后触发 OnConnect
+	responded    bool         // 响应已经推送给客户端，处理完成后不再推送
+	received     bool         // 适配器读取消息时已经统计过收到的消息数
+	cred         *Credentials // 本次请求的认证信息，优先于适配器提供的会话认证信息
+}
+
+// Context 获取当前请求的 context.Context，在会话关闭、服务关闭、请求超时或处理函数执行完成时会被取消
+// 调用数据库或下游服务时应该传递该值
+func (c *Context) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// WithContext 替换当前请求的 context.Context，一般在中间件中使用，如设置更短的超时或者携带值
+// 新的 ctx 应该派生自 c.Context()，否则会丢失会话关闭等取消通知
+func (c *Context) WithContext(ctx context.Context) *Context {
+	if ctx == nil {
+		panic("nil context")
+	}
+	c.ctx = ctx
+	return c
 }
 
 // Next 调用下一层中间件。
@@ -46,10 +75,16 @@ func (c *Context) Abort() {
 	c.handlerAbort = true
 }
 
+// Param 获取模式路由匹配到的参数，如路由 room.:id.join 匹配命令 room.100.join 时，c.Param("id") 为 "100"
+func (c *Context) Param(name string) string {
+	return c.params[name]
+}
+
 // Parse 解析并验证消息携带的参数，参考 Goframe 的 请求输入-对象处理 https://goframe.org/pages/viewpage.action?pageId=1114185
 // 支持 json 和 xml 数据流
 // 支持将数据解析为 *struct/**struct/*[]struct/*[]*struct/*map/*[]map
 // 如果目标值是 *struct/**struct/*[]struct/*[]*struct ，则会自动调用请求验证，参考 GoFrame 的 请求输入-请求校验 https://goframe.org/pages/viewpage.action?pageId=1114244
+// 自定义规则、错误消息的翻译和字段级别的错误响应见 Srv.SetValidation
 func (c *Context) Parse(pointer interface{}, mapping ...map[string]string) error {
 	var (
 		rv = reflect.ValueOf(pointer)
@@ -79,18 +114,26 @@ func (c *Context) Parse(pointer interface{}, mapping ...map[string]string) error
 		if err := data.GetStruct(".", pointer, mapping...); err != nil {
 			return err
 		}
-		if err := gvalid.CheckStruct(context.TODO(), pointer, nil); err != nil {
+		if err := c.validate(pointer, ""); err != nil {
 			return err
 		}
 	case reflect.Array, reflect.Slice:
 		if err := data.GetStructs(".", pointer, mapping...); err != nil {
 			return err
 		}
+		var errs []*Error
 		for i := 0; i < rv.Len(); i++ {
-			if err := gvalid.CheckStruct(context.TODO(), rv.Index(i), nil); err != nil {
-				return err
+			if err := c.validate(rv.Index(i), indexPrefix(i)); err != nil {
+				e, ok := err.(*Error)
+				if !ok {
+					return err
+				}
+				errs = append(errs, e)
 			}
 		}
+		if len(errs) > 0 {
+			return mergeValidationErrors(errs)
+		}
 	case reflect.Map:
 		if err := data.MapToMap(pointer); err != nil {
 			return err
@@ -127,19 +170,19 @@ func (c *Context) Exit(code int) {
 	panic(internalExitPanic)
 }
 
-// IfErrExit 如果 err 不为空，则中断执行并直接返回
+// IfErrExit 如果 err 不为空，则中断执行并直接返回，响应码的规则和 Err 一样
 func (c *Context) IfErrExit(err error, code int) {
 	if err != nil {
 		c.Err(err, code)
-		c.Exit(code)
+		c.Exit(c.Response.Code)
 	}
 }
 
 // Err 响应错误，如果错误对象为空则忽略不处理
+// 错误链中有 *cs.Error 时使用它的响应码、消息和数据，code 作为它没有响应码时的默认值
 func (c *Context) Err(err error, code int) {
 	if err != nil {
-		c.Response.Code = code
-		c.Response.Msg = err.Error()
+		c.setError(err, code)
 	}
 }
 
@@ -168,40 +211,12 @@ func (c *Context) Resp(code int, msg string, data ...interface{}) {
 
 // Push 往当前会话推送消息
 func (c *Context) Push(data *Response) error {
-	ctx, err := c.Srv.callPushMiddleware(c, data)
-	if err != nil {
-		return err
-	}
-	// data.fill()
-	// logger := c.Get(loggerCtxKey)
-	// if logger != nil {
-	// 	name, ok := c.Get(loggerNameCtxKey).(string)
-	// 	if !ok {
-	// 		name = "SRV"
-	// 	}
-	// 	logger.(printLogger).Debug(fmt.Sprintf("%s PUSH SID=%s CMD=%s SEQ=%s Code=%d Msg=%s %s",
-	// 		name, c.SID, data.Cmd, data.Seqno, data.Code, data.Msg, getLogDataString(data.Data)))
-	// }
-	return c.Srv.PushServer(c.Server, c.SID, ctx.Response)
+	return c.Srv.pushServer(c, c.spanContext(), c.Server, c.SID, data)
 }
 
 // PushSID 往指定SID会话推送消息
 func (c *Context) PushSID(sid string, data *Response) error {
-	ctx, err := c.Srv.callPushMiddleware(c, data)
-	if err != nil {
-		return err
-	}
-	// data.fill()
-	// logger := c.Get(loggerCtxKey)
-	// if logger != nil {
-	// 	name, ok := c.Get(loggerNameCtxKey).(string)
-	// 	if !ok {
-	// 		name = "SRV"
-	// 	}
-	// 	logger.(printLogger).Debug(fmt.Sprintf("%s PUSH SID=%s CMD=%s SEQ=%s Code=%d Msg=%s %s",
-	// 		name, sid, data.Cmd, data.Seqno, data.Code, data.Msg, getLogDataString(data.Data)))
-	// }
-	return c.Srv.Push(sid, ctx.Response)
+	return c.Srv.pushSID(c, sid, data)
 }
 
 // Close 关闭当前会话连接
@@ -219,17 +234,21 @@ func (c *Context) GetServerAllSID() []string {
 	return c.Server.GetAllSID()
 }
 
-// Broadcast 广播消息，即给所有有效的会话推送消息
-func (c *Context) Broadcast(data *Response) {
-	// c.Srv.Broadcast(data)
-	for _, server := range c.Srv.Server {
-		for _, sid := range server.GetAllSID() {
-			ctx, err := c.Srv.callPushMiddleware(c, data)
-			if err == nil {
-				go server.Write(sid, ctx.Response)
-			}
-		}
-	}
+// Broadcast 广播消息，即给所有有效的会话推送消息，消息会经过推送中间件
+// 会阻塞直到所有的会话都推送完成并返回推送的结果，不需要等待时使用 BroadcastAsync
+func (c *Context) Broadcast(data *Response) *BroadcastResult {
+	return c.Srv.broadcast(c, nil, data)
+}
+
+// BroadcastAsync 在新的 goroutine 中广播消息，不等待推送完成
+func (c *Context) BroadcastAsync(data *Response) {
+	// 先复制上下文，处理函数返回后还会修改当前的上下文
+	go c.Srv.broadcast(c.clone(), nil, data)
+}
+
+// BroadcastFilter 给 filter 返回 true 的会话推送消息
+func (c *Context) BroadcastFilter(filter func(sid string) bool, data *Response) *BroadcastResult {
+	return c.Srv.broadcast(c, filter, data)
 }
 
 func (c *Context) clone() *Context {
@@ -251,10 +270,34 @@ func (c *Context) clone() *Context {
 		Server:       c.Server,
 		handlers:     nil,
 		handlerIndex: -1,
+		ctx:          c.ctx,
+		params:       c.params,
+		span:         c.span,
+		cred:         c.cred,
 	}
 }
 
+// 监控指标中的命令标签，使用匹配到的路由，避免客户端发送任意命令导致指标无限增长
+func (c *Context) metricCmd() string {
+	if c.route != "" {
+		return c.route
+	}
+	return "unmatched"
+}
+
 // RouteNotFound 当路由没匹配到时的默认处理函数
 func RouteNotFound(c *Context) {
-	c.Resp(-1, msgUnsupportCmd)
+	c.Resp(CodeUnsupportCmd, msgUnsupportCmd)
+}
+
+// RemoteAddr 当前会话的远程地址，适配器没有实现 RemoteAddrAdapter 时返回空字符串
+// 设置了本次请求的认证信息时使用请求的远程地址
+func (c *Context) RemoteAddr() string {
+	if c.cred != nil && c.cred.RemoteAddr != "" {
+		return c.cred.RemoteAddr
+	}
+	if a, ok := c.Server.(RemoteAddrAdapter); ok {
+		return a.RemoteAddr(c.SID)
+	}
+	return ""
 }
@@ -0,0 +1,345 @@
+package cs
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DispatchMode 消息的调度模式，决定适配器读取到的消息如何执行处理函数
+type DispatchMode int
+
+const (
+	// DispatchConcurrent 每个消息都在新的 goroutine 中执行，同一个会话的消息可能乱序处理和响应，默认的模式
+	DispatchConcurrent DispatchMode = iota
+	// DispatchSerialSID 同一个会话的消息按顺序依次处理，不同会话之间并发处理
+	DispatchSerialSID
+	// DispatchSerialKey 同一个会话中相同 key 的消息按顺序依次处理，key 默认为消息的命令
+	DispatchSerialKey
+)
+
+// 默认的队列长度
+const defaultDispatchQueueSize = 64
+
+// DispatchConfig 消息调度的配置
+type DispatchConfig struct {
+	Mode DispatchMode
+	// QueueSize 串行模式下每个队列最多等待处理的消息数量，默认为 64
+	// 队列满了之后新的消息会被丢弃并直接响应 OverflowCode，内置命令不会被丢弃
+	QueueSize int
+	// Key DispatchSerialKey 模式下消息的排队 key，默认为消息的命令
+	Key func(sid string, req *Request) string
+	// Workers 执行处理函数的 goroutine 数量，默认为 0，即每个消息(串行模式下为每个队列)启动一个新的 goroutine
+	// 所有 worker 都在忙时会阻塞读取适配器的消息，开启 Shed 时直接丢弃消息，串行模式下只有需要开始执行的空闲队列会被丢弃
+	Workers int
+	// MaxInFlight 最多同时在处理(包括排队中)的消息数量，默认为 0 不限制
+	// 达到限制时会阻塞读取适配器的消息，直到有消息处理完成，开启 Shed 时直接丢弃消息
+	// 处理函数通过 Srv.Request 等待客户端回复时不占用限制，需要传递 c.Context()
+	MaxInFlight int
+	// Shed 达到 Workers 或 MaxInFlight 的限制时，丢弃新的消息并直接响应 OverflowCode，而不是阻塞读取，内置命令不会被丢弃
+	Shed bool
+	// OverflowCode 消息被丢弃时的响应码，默认为 CodeBusy
+	OverflowCode int
+	// OverflowMsg 消息被丢弃时的响应消息，默认为 "server busy"
+	OverflowMsg string
+}
+
+// DispatchStats 消息调度的统计数据
+type DispatchStats struct {
+	Running  int64  // 正在执行处理函数的消息数量
+	Pending  int64  // 已接收，等待执行的消息数量
+	Handled  uint64 // 已处理完成的消息总数
+	Overflow uint64 // 因串行队列已满被丢弃的消息总数
+	Shed     uint64 // 因达到 Workers 或 MaxInFlight 的限制被丢弃的消息总数
+}
+
+// SetDispatch 设置消息的调度模式，应该在 Run 之前调用
+// 只影响通过适配器 Read 读取的消息，直接调用 CallContext 的请求(如 HTTP 的命令请求)不受影响
+// srv.SetDispatch(cs.DispatchConfig{Mode: cs.DispatchSerialSID})
+// srv.SetDispatch(cs.DispatchConfig{Workers: 100, MaxInFlight: 1000, Shed: true})
+func (s *Srv) SetDispatch(conf DispatchConfig) *Srv {
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = defaultDispatchQueueSize
+	}
+	if conf.Key == nil {
+		conf.Key = func(sid string, req *Request) string {
+			return req.Cmd
+		}
+	}
+	if conf.OverflowCode == 0 {
+		conf.OverflowCode = CodeBusy
+	}
+	if conf.OverflowMsg == "" {
+		conf.OverflowMsg = msgBusy
+	}
+	if s.dispatcher != nil {
+		s.dispatcher.stop()
+	}
+	s.dispatcher = newDispatcher(conf)
+	return s
+}
+
+// DispatchStats 获取消息调度的统计数据，用于监控
+func (s *Srv) DispatchStats() DispatchStats {
+	return s.dispatcher.stats()
+}
+
+// 消息调度器
+type dispatcher struct {
+	conf     DispatchConfig
+	mu       sync.Mutex
+	queues   map[string]*dispatchQueue // 串行模式下的消息队列，队列为空时删除
+	pool     chan func()               // worker 的任务，没有设置 Workers 时为 nil
+	sem      chan struct{}             // 处理中的消息的信号量，没有设置 MaxInFlight 时为 nil
+	quit     chan struct{}             // 停止所有 worker
+	quitOnce sync.Once
+	busy     int64 // 已占用的 worker 数量
+	running  int64
+	pending  int64
+	handled  uint64
+	overflow uint64
+	shed     uint64
+}
+
+// 串行执行的消息队列，有消息时才会开始执行
+type dispatchQueue struct {
+	tasks   []func()
+	running bool
+}
+
+func newDispatcher(conf DispatchConfig) *dispatcher {
+	d := &dispatcher{
+		conf:   conf,
+		queues: map[string]*dispatchQueue{},
+		quit:   make(chan struct{}),
+	}
+	if conf.MaxInFlight > 0 {
+		d.sem = make(chan struct{}, conf.MaxInFlight)
+	}
+	if conf.Workers > 0 {
+		d.pool = make(chan func())
+		for i := 0; i < conf.Workers; i++ {
+			go d.worker()
+		}
+	}
+	return d
+}
+
+func (d *dispatcher) worker() {
+	for {
+		select {
+		case task := <-d.pool:
+			task()
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// 停止所有 worker，之后的消息都在新的 goroutine 中执行
+func (d *dispatcher) stop() {
+	d.quitOnce.Do(func() {
+		close(d.quit)
+	})
+}
+
+// 调度消息，返回 false 时表示消息被丢弃
+// 内置命令不会被丢弃，也不受 MaxInFlight 的限制，task 的参数为消息占用的信号量，不受限制时为 nil
+func (d *dispatcher) dispatch(sid string, req *Request, task func(slot *flightSlot)) bool {
+	internal := isInternalCmd(req.Cmd)
+	var slot *flightSlot
+	if d.sem != nil && !internal {
+		if !d.acquire() {
+			atomic.AddUint64(&d.shed, 1)
+			return false
+		}
+		slot = &flightSlot{d: d, held: true}
+	}
+	atomic.AddInt64(&d.pending, 1)
+	run := func() {
+		atomic.AddInt64(&d.pending, -1)
+		atomic.AddInt64(&d.running, 1)
+		defer func() {
+			atomic.AddInt64(&d.running, -1)
+			atomic.AddUint64(&d.handled, 1)
+			slot.release()
+		}()
+		task(slot)
+	}
+
+	key := sid
+	switch d.conf.Mode {
+	case DispatchSerialSID:
+	case DispatchSerialKey:
+		key = sid + "\x00" + d.conf.Key(sid, req)
+	default:
+		if !d.reserve(internal) {
+			atomic.AddInt64(&d.pending, -1)
+			atomic.AddUint64(&d.shed, 1)
+			slot.release()
+			return false
+		}
+		d.submit(run)
+		return true
+	}
+
+	d.mu.Lock()
+	q, ok := d.queues[key]
+	if !ok {
+		q = &dispatchQueue{}
+		d.queues[key] = q
+	}
+	if len(q.tasks) >= d.conf.QueueSize && !internal {
+		d.mu.Unlock()
+		atomic.AddInt64(&d.pending, -1)
+		atomic.AddUint64(&d.overflow, 1)
+		slot.release()
+		return false
+	}
+	// 空闲的队列需要占用一个 worker 才能开始执行，所有 worker 都在忙并且开启了 Shed 时丢弃消息
+	start := !q.running
+	if start && !d.reserve(internal) {
+		if !ok {
+			delete(d.queues, key)
+		}
+		d.mu.Unlock()
+		atomic.AddInt64(&d.pending, -1)
+		atomic.AddUint64(&d.shed, 1)
+		slot.release()
+		return false
+	}
+	q.tasks = append(q.tasks, run)
+	q.running = true
+	d.mu.Unlock()
+	if start {
+		d.submit(func() { d.run(key, q) })
+	}
+	return true
+}
+
+// 获取处理中消息的信号量，开启 Shed 时不等待
+func (d *dispatcher) acquire() bool {
+	if d.conf.Shed {
+		select {
+		case d.sem <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case d.sem <- struct{}{}:
+		return true
+	case <-d.quit:
+		return false
+	}
+}
+
+// 占用一个 worker，没有设置 Workers 时总是成功
+// 开启 Shed 并且所有 worker 都在忙时返回 false，must 为 true 时总是会占用
+func (d *dispatcher) reserve(must bool) bool {
+	if d.pool == nil {
+		return true
+	}
+	// 先占用 worker，避免 worker 刚执行完任务还没开始接收时被误判为忙
+	if atomic.AddInt64(&d.busy, 1) > int64(d.conf.Workers) && d.conf.Shed && !must {
+		atomic.AddInt64(&d.busy, -1)
+		return false
+	}
+	return true
+}
+
+// 执行任务，需要先调用 reserve，设置了 Workers 时交给 worker 执行
+func (d *dispatcher) submit(task func()) {
+	if d.pool == nil {
+		go task()
+		return
+	}
+	wrapped := func() {
+		defer atomic.AddInt64(&d.busy, -1)
+		task()
+	}
+	select {
+	case d.pool <- wrapped:
+	case <-d.quit:
+		go wrapped()
+	}
+}
+
+// 依次执行队列中的消息，队列为空时退出
+func (d *dispatcher) run(key string, q *dispatchQueue) {
+	for {
+		d.mu.Lock()
+		if len(q.tasks) == 0 {
+			q.running = false
+			delete(d.queues, key)
+			d.mu.Unlock()
+			return
+		}
+		task := q.tasks[0]
+		q.tasks[0] = nil
+		q.tasks = q.tasks[1:]
+		d.mu.Unlock()
+		task()
+	}
+}
+
+func (d *dispatcher) stats() DispatchStats {
+	return DispatchStats{
+		Running:  atomic.LoadInt64(&d.running),
+		Pending:  atomic.LoadInt64(&d.pending),
+		Handled:  atomic.LoadUint64(&d.handled),
+		Overflow: atomic.LoadUint64(&d.overflow),
+		Shed:     atomic.LoadUint64(&d.shed),
+	}
+}
+
+// 消息占用的 MaxInFlight 信号量，等待客户端回复时暂时归还，避免阻塞读取回复的消息
+type flightSlot struct {
+	d       *dispatcher
+	mu      sync.Mutex
+	held    bool // 是否占用了信号量
+	waiting int  // 正在等待回复的 Srv.Request 数量
+	done    bool // 消息已处理完成
+}
+
+type flightSlotKey struct{}
+
+// 开始等待回复，归还信号量
+func (f *flightSlot) yield() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.waiting++
+	if f.waiting == 1 && f.held {
+		<-f.d.sem
+		f.held = false
+	}
+}
+
+// 等待回复结束，重新占用信号量，消息已处理完成时不再占用
+func (f *flightSlot) resume() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.waiting--
+	if f.waiting > 0 || f.done || f.held {
+		return
+	}
+	select {
+	case f.d.sem <- struct{}{}:
+		f.held = true
+	case <-f.d.quit:
+	}
+}
+
+// 消息处理完成，归还信号量
+func (f *flightSlot) release() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.done = true
+	if f.held {
+		<-f.d.sem
+		f.held = false
+	}
+}
@@ -0,0 +1,172 @@
+package cs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Error 携带响应码的错误，Msg 和 Data 会响应给客户端，Err 是内部的原因，只用于日志和 errors.Is/As
+// 处理函数可以通过 c.Err, c.IfErrExit, panic 或者 Typed 处理函数返回该错误，都会使用它的响应码、消息和数据响应
+// var ErrUserNotFound = cs.RegisterError(1001, "user not found")
+// return nil, ErrUserNotFound.Wrap(err)
+type Error struct {
+	Code int         // 响应码
+	Msg  string      // 响应消息，为空时使用注册的消息
+	Data interface{} // 响应数据，为空时不改变响应的数据
+	Err  error       // 内部的原因
+}
+
+// NewError 创建错误
+func NewError(code int, msg string) *Error {
+	return &Error{Code: code, Msg: msg}
+}
+
+// Error 实现 error 接口，包含内部的原因
+func (e *Error) Error() string {
+	msg := e.publicMsg()
+	if e.Err == nil {
+		return msg
+	}
+	if msg == "" {
+		return e.Err.Error()
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// ErrCode 实现 CodedError 接口
+func (e *Error) ErrCode() int {
+	return e.Code
+}
+
+// Unwrap 内部的原因
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is 响应码相同的 *Error 视为同一个错误，errors.Is(err, ErrUserNotFound) 对 Wrap 和 WithData 的结果也成立
+// 没有响应码的错误还需要消息相同
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code && (e.Code != 0 || t.Msg == e.Msg)
+}
+
+// Wrap 复制一个错误，设置内部的原因
+func (e *Error) Wrap(err error) *Error {
+	c := *e
+	c.Err = err
+	return &c
+}
+
+// WithData 复制一个错误，设置响应数据
+func (e *Error) WithData(data interface{}) *Error {
+	c := *e
+	c.Data = data
+	return &c
+}
+
+// WithMsg 复制一个错误，设置响应消息
+func (e *Error) WithMsg(format string, args ...interface{}) *Error {
+	c := *e
+	c.Msg = fmt.Sprintf(format, args...)
+	return &c
+}
+
+// 响应给客户端的消息
+func (e *Error) publicMsg() string {
+	if e.Msg != "" {
+		return e.Msg
+	}
+	if reg := lookupError(e.Code); reg != nil {
+		return reg.Msg
+	}
+	return ""
+}
+
+var (
+	errorRegistryMu sync.RWMutex
+	errorRegistry   = map[int]*Error{}
+)
+
+// 内置响应码
+func init() {
+	for code, msg := range map[int]string{
+		CodeUnsupportCmd: msgUnsupportCmd,
+		CodePanic:        "handler panic",
+		CodeTimeout:      msgTimeout,
+		CodeBadRequest:   "bad request",
+		CodeError:        "error",
+		CodeBusy:         msgBusy,
+		CodeRateLimit:    msgRateLimit,
+		CodeUnauthorized: msgUnauthorized,
+		CodeValidation:   msgValidation,
+	} {
+		RegisterError(code, msg)
+	}
+}
+
+// RegisterError 注册应用的响应码和对外的消息，返回的错误可以作为哨兵错误使用
+// 响应码不能为 0，也不能重复注册，否则会 panic，一般在包级别的变量中注册
+// var ErrUserNotFound = cs.RegisterError(1001, "user not found")
+func RegisterError(code int, msg string) *Error {
+	if code == 0 {
+		panic("cs: RegisterError with code 0")
+	}
+	errorRegistryMu.Lock()
+	defer errorRegistryMu.Unlock()
+	if _, ok := errorRegistry[code]; ok {
+		panic(fmt.Sprintf("cs: error code %d already registered", code))
+	}
+	e := &Error{Code: code, Msg: msg}
+	errorRegistry[code] = e
+	return e
+}
+
+// ErrorCodes 所有注册的响应码，包括内置的响应码，按响应码排序
+func ErrorCodes() []*Error {
+	errorRegistryMu.RLock()
+	list := make([]*Error, 0, len(errorRegistry))
+	for _, e := range errorRegistry {
+		c := *e
+		list = append(list, &c)
+	}
+	errorRegistryMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list
+}
+
+func lookupError(code int) *Error {
+	errorRegistryMu.RLock()
+	defer errorRegistryMu.RUnlock()
+	return errorRegistry[code]
+}
+
+// SetErrorMapper 设置错误的映射函数，用于把内部错误转换为对外的错误，避免把内部错误的消息响应给客户端
+// 响应错误时，错误链中没有 *Error 的错误会先调用 f，f 返回 nil 时使用错误本身的消息
+// srv.SetErrorMapper(func(err error) *cs.Error { return ErrInternal.Wrap(err) })
+func (s *Srv) SetErrorMapper(f func(err error) *Error) *Srv {
+	s.errorMapper = f
+	return s
+}
+
+// 设置错误的响应，错误链中有 *Error 时使用它的响应码、消息和数据，否则使用 code 和 err.Error()
+func (c *Context) setError(err error, code int) {
+	var e *Error
+	if !errors.As(err, &e) && c.Srv != nil && c.Srv.errorMapper != nil {
+		e = c.Srv.errorMapper(err)
+	}
+	if e == nil {
+		c.Response.Code = code
+		c.Response.Msg = err.Error()
+		return
+	}
+	if e.Code != 0 {
+		code = e.Code
+	}
+	c.Response.Code = code
+	c.Response.Msg = e.publicMsg()
+	if e.Data != nil {
+		c.Response.Data = e.Data
+	}
+}
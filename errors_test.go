@@ -0,0 +1,154 @@
+package cs_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+var (
+	errTestNotFound = cs.RegisterError(1001, "not found")
+	errTestInternal = cs.RegisterError(1002, "internal error")
+	errTestDB       = errors.New("sql: no rows")
+)
+
+func TestError(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		err := errTestNotFound.Wrap(errTestDB)
+		t.Assert(err.Error(), "not found: sql: no rows")
+		t.Assert(errors.Is(err, errTestNotFound), true)
+		t.Assert(errors.Is(err, errTestDB), true)
+		t.Assert(errors.Is(err, errTestInternal), false)
+		t.Assert(cs.ErrCode(err, cs.CodeError), 1001)
+		t.Assert(errTestNotFound.Err, nil)
+
+		// 没有响应码的错误使用默认的响应码，并且按消息区分
+		t.Assert(cs.ErrCode(&cs.Error{Msg: "x"}, cs.CodeError), cs.CodeError)
+		t.Assert(errors.Is(&cs.Error{Msg: "x"}, &cs.Error{Msg: "y"}), false)
+		t.Assert(errors.Is((&cs.Error{Msg: "x"}).Wrap(errTestDB), &cs.Error{Msg: "x"}), true)
+
+		codes := map[int]string{}
+		for _, e := range cs.ErrorCodes() {
+			codes[e.Code] = e.Msg
+		}
+		t.Assert(codes[1001], "not found")
+		t.Assert(codes[cs.CodeRateLimit], "too many requests")
+
+		defer func() {
+			t.AssertNE(recover(), nil)
+		}()
+		cs.RegisterError(1001, "again")
+	})
+}
+
+func TestError_Response(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetLogger(cs.NopLogger)
+		srv.Use(cs.Recover())
+		srv.Handle("err", func(c *cs.Context) {
+			c.Err(errTestNotFound.WithData(map[string]string{"id": "1"}), cs.CodeError)
+		})
+		srv.Handle("exit", func(c *cs.Context) {
+			c.IfErrExit(errTestNotFound.Wrap(errTestDB), cs.CodeError)
+			c.OK()
+		})
+		srv.Handle("panic", func(c *cs.Context) {
+			panic(errTestNotFound.WithMsg("user %s not found", "a"))
+		})
+		srv.Handle("typed", cs.Typed(func(c *cs.Context, req *struct{}) (*struct{}, error) {
+			return nil, errTestDB
+		}))
+		srv.Handle("typed.nocode", cs.Typed(func(c *cs.Context, req *struct{}) (*struct{}, error) {
+			return nil, &cs.Error{Msg: "x"}
+		}))
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "err"}
+		resp := <-server.written
+		t.Assert(resp.Code, 1001)
+		t.Assert(resp.Msg, "not found")
+		t.Assert(resp.Data, map[string]string{"id": "1"})
+
+		server.receive <- &cs.Request{Cmd: "exit"}
+		resp = <-server.written
+		t.Assert(resp.Code, 1001)
+		t.Assert(resp.Msg, "not found")
+
+		server.receive <- &cs.Request{Cmd: "panic"}
+		resp = <-server.written
+		t.Assert(resp.Code, 1001)
+		t.Assert(resp.Msg, "user a not found")
+
+		server.receive <- &cs.Request{Cmd: "typed"}
+		resp = <-server.written
+		t.Assert(resp.Code, cs.CodeError)
+		t.Assert(resp.Msg, "sql: no rows")
+
+		server.receive <- &cs.Request{Cmd: "typed.nocode"}
+		resp = <-server.written
+		t.Assert(resp.Code, cs.CodeError)
+		t.Assert(resp.Msg, "x")
+
+		srv.SetErrorMapper(func(err error) *cs.Error {
+			return errTestInternal.Wrap(err)
+		})
+		server.receive <- &cs.Request{Cmd: "typed"}
+		resp = <-server.written
+		t.Assert(resp.Code, 1002)
+		t.Assert(resp.Msg, "internal error")
+	})
+}
+
+func TestRecover_ExitInMiddleware(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		panics := make(chan interface{}, 1)
+		srv.OnPanic(func(c *cs.Context, v interface{}, stack []byte) {
+			panics <- v
+		})
+		srv.Use(cs.Recover(), func(c *cs.Context) {
+			if c.Cmd != "open" {
+				c.Resp(1001, "denied")
+				c.Exit(1001)
+			}
+			c.Next()
+		})
+		handled := make(chan string, 2)
+		srv.Handle("open", func(c *cs.Context) {
+			handled <- c.Cmd
+			c.OK()
+		})
+		srv.Handle("closed", func(c *cs.Context) {
+			handled <- c.Cmd
+			c.OK()
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "closed"}
+		resp := <-server.written
+		t.Assert(resp.Code, 1001)
+		t.Assert(resp.Msg, "denied")
+
+		server.receive <- &cs.Request{Cmd: "unmatched"}
+		resp = <-server.written
+		t.Assert(resp.Code, 1001)
+
+		server.receive <- &cs.Request{Cmd: "open"}
+		resp = <-server.written
+		t.Assert(resp.Code, 0)
+		t.Assert(<-handled, "open")
+		t.Assert(len(panics), 0)
+	})
+}
@@ -9,6 +9,9 @@ import (
 	"github.com/eyasliu/cs/xwebsocket"
 )
 
+// 聊天室的房间名，注册后的会话加入该房间
+const chatRoom = "chat"
+
 func assert(err error) {
 	if err != nil {
 		panic(err)
@@ -36,6 +39,7 @@ func main() {
 		assert(c.Parse(&body))
 
 		c.Set("name", body.Name)
+		c.Join(chatRoom)
 
 		c.Push(&cs.Response{
 			Cmd:  "welcome",
@@ -68,31 +72,19 @@ func main() {
 			"name":    name,
 			"message": body.Message,
 		}
-		pushMsg := &cs.Response{
+		c.BroadcastRoom(chatRoom, &cs.Response{
 			Cmd:  "push_message",
 			Data: msg,
-		}
-		for _, sid := range c.GetAllSID() {
-			if c.GetState(sid, "name") != nil {
-				c.PushSID(sid, pushMsg)
-			} else {
-				c.PushSID(sid, &cs.Response{
-					Cmd: "hide_message",
-				})
-			}
-		}
+		})
 	})
+	// 会话关闭后才会自动退出房间，这里排除正在关闭的会话
 	user.Handle(cs.CmdClosed, func(c *cs.Context) {
-		for _, sid := range c.GetAllSID() {
-			if c.GetState(sid, "name") != nil {
-				c.PushSID(sid, &cs.Response{
-					Cmd: "user_offline",
-					Data: map[string]interface{}{
-						"name": c.Get("name"),
-					},
-				})
-			}
-		}
+		c.BroadcastRoom(chatRoom, &cs.Response{
+			Cmd: "user_offline",
+			Data: map[string]interface{}{
+				"name": c.Get("name"),
+			},
+		}, c.SID)
 	})
 
 	srv.Run()
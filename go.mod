@@ -1,9 +1,20 @@
 module github.com/eyasliu/cs
 
-go 1.12
+go 1.18
 
 require (
 	github.com/gogf/gf v1.16.9
 	github.com/gorilla/websocket v1.4.2
+)
+
+require (
+	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/clbanning/mxj v1.8.5-0.20200714211355-ff02cfb8ea28 // indirect
+	github.com/fsnotify/fsnotify v1.4.9 // indirect
 	github.com/mattn/go-runewidth v0.0.13 // indirect
+	go.opentelemetry.io/otel v1.0.0 // indirect
+	go.opentelemetry.io/otel/trace v1.0.0 // indirect
+	golang.org/x/sys v0.0.0-20210423082822-04245dca01da // indirect
+	golang.org/x/text v0.3.6 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
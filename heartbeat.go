@@ -21,8 +21,12 @@ func Heartbeat(timeout time.Duration, srv *Srv) HandlerFunc {
 			heartbeatTime.Range(func(key, val interface{}) bool {
 				if hbTime, ok := val.(int64); !ok || hbTime < to {
 					sid := key.(string)
-					srv.Close(sid)
+					srv.logger.Log(LevelInfo, "heartbeat timeout", "sid", sid)
+					if server, err := srv.getSidServer(sid); err == nil {
+						srv.closeWithReason(server, sid, CloseReasonHeartbeat)
+					}
 					heartbeatTime.Delete(sid)
+					srv.metrics.heartbeatTimeouts.add(1)
 				}
 				return true
 			})
@@ -0,0 +1,107 @@
+package cs
+
+import (
+	"runtime/debug"
+)
+
+// CloseReason 会话关闭的原因
+type CloseReason string
+
+// 会话关闭的原因
+const (
+	CloseReasonRemote       CloseReason = "remote"       // 客户端断开或者连接出错
+	CloseReasonServer       CloseReason = "server"       // 服务端调用了 Close
+	CloseReasonHeartbeat    CloseReason = "heartbeat"    // 心跳超时
+	CloseReasonUnauthorized CloseReason = "unauthorized" // 认证失败或者认证过期
+	CloseReasonShutdown     CloseReason = "shutdown"     // 服务关闭
+)
+
+// OnConnect 添加会话建立时的回调，在认证通过之后、会话的 CmdConnected 处理函数之前调用，不需要注册 CmdConnected 路由
+// 设置了 OnAuthenticate 时认证失败的会话不会触发，使用 Auth.Require 延后认证的会话在 OnAuthenticate 返回后触发
+// 只有会产生 CmdConnected 消息的适配器才会触发，回调在会话的消息调度中执行，不要长时间阻塞
+func (s *Srv) OnConnect(f func(sid string, server ServerAdapter)) *Srv {
+	s.connectHooks = append(s.connectHooks, f)
+	return s
+}
+
+// OnClose 添加会话关闭时的回调，在会话的 CmdClosed 处理函数之后调用，此时会话的状态、房间和用户还没有清理
+// 服务端关闭的会话 reason 为关闭的原因，其他情况为 CloseReasonRemote
+func (s *Srv) OnClose(f func(sid string, reason CloseReason)) *Srv {
+	s.closeUserHooks = append(s.closeUserHooks, f)
+	return s
+}
+
+// OnAdapterError 添加适配器读取消息失败时的回调，之后 Run 会返回该错误，关闭服务时的错误不会触发
+func (s *Srv) OnAdapterError(f func(server ServerAdapter, err error)) *Srv {
+	s.adapterErrorHooks = append(s.adapterErrorHooks, f)
+	return s
+}
+
+// OnPushError 添加推送消息失败时的回调，包括写入连接失败，以及发送队列满了之后被丢弃的消息
+// 错误可能是 ErrQueueFull, ErrQueueDropped, ErrSlowConsumer, ErrQueueClosed 或者连接的写入错误
+func (s *Srv) OnPushError(f func(sid string, resp *Response, err error)) *Srv {
+	s.pushErrorHooks = append(s.pushErrorHooks, f)
+	return s
+}
+
+// OnPanic 添加处理函数 panic 时的回调，v 为 panic 的值，stack 为调用栈
+// 在发生 panic 的 goroutine 中调用，此时 panic 还没有被 Recover 中间件恢复，没有使用 Recover 时随后程序崩溃
+func (s *Srv) OnPanic(f func(c *Context, v interface{}, stack []byte)) *Srv {
+	s.panicHooks = append(s.panicHooks, f)
+	return s
+}
+
+// 会话建立
+func (s *Srv) onSidConnected(server ServerAdapter, sid string) {
+	for _, hook := range s.connectHooks {
+		hook(sid, server)
+	}
+}
+
+// 推送消息失败
+func (s *Srv) pushFailed(sid string, resp *Response, err error) {
+	if s.writeErrorHandler != nil {
+		s.writeErrorHandler(sid, resp, err)
+	}
+	for _, hook := range s.pushErrorHooks {
+		hook(sid, resp, err)
+	}
+}
+
+// 适配器读取消息失败
+func (s *Srv) adapterFailed(server ServerAdapter, err error) {
+	s.logger.Log(LevelError, "adapter read failed", "adapter", adapterName(server), "error", err)
+	for _, hook := range s.adapterErrorHooks {
+		hook(server, err)
+	}
+}
+
+// 处理函数 panic，内部的 panic 处理和 Recover 都会调用，同一个请求只通知一次
+func (s *Srv) panicked(c *Context, v interface{}) {
+	if c.panicked {
+		return
+	}
+	c.panicked = true
+	stack := debug.Stack()
+	s.logger.Log(LevelError, "handler panic", "sid", c.SID, "cmd", c.Cmd, "panic", v, "stack", string(stack))
+	for _, hook := range s.panicHooks {
+		hook(c, v, stack)
+	}
+}
+
+// 关闭会话并记录原因，同一个会话以第一次记录的原因为准
+// 只记录已注册的会话，它们关闭时适配器会产生 CmdClosed 消息来清理原因
+func (s *Srv) closeWithReason(server ServerAdapter, sid string, reason CloseReason) error {
+	if _, ok := s.sessions.Load(sid); ok {
+		s.closeReasons.LoadOrStore(sid, reason)
+	}
+	return server.Close(sid)
+}
+
+// 会话关闭的原因，没有记录时为 CloseReasonRemote
+func (s *Srv) takeCloseReason(sid string) CloseReason {
+	if val, ok := s.closeReasons.LoadAndDelete(sid); ok {
+		return val.(CloseReason)
+	}
+	return CloseReasonRemote
+}
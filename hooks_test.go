@@ -0,0 +1,104 @@
+package cs_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+type errAdapter struct {
+	*chanAdapter
+}
+
+func (a *errAdapter) Read(r *cs.Srv) (string, *cs.Request, error) {
+	return "", nil, errors.New("read failed")
+}
+
+func TestSrv_LifecycleHooks(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetLogger(cs.NopLogger)
+		srv.Use(cs.Recover())
+
+		connected := make(chan string, 1)
+		closed := make(chan cs.CloseReason, 1)
+		panics := make(chan interface{}, 1)
+		pushErrs := make(chan error, 1)
+		srv.OnConnect(func(sid string, s cs.ServerAdapter) {
+			t.Assert(s, server)
+			connected <- sid
+		})
+		srv.OnClose(func(sid string, reason cs.CloseReason) {
+			t.Assert(sid, "1")
+			closed <- reason
+		})
+		srv.OnPanic(func(c *cs.Context, v interface{}, stack []byte) {
+			t.AssertGT(len(stack), 0)
+			panics <- v
+		})
+		srv.OnPushError(func(sid string, resp *cs.Response, err error) {
+			pushErrs <- err
+		})
+		srv.Handle("boom", func(c *cs.Context) {
+			panic("boom")
+		})
+		srv.Handle("bye", func(c *cs.Context) {
+			c.Close()
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: cs.CmdConnected}
+		t.Assert(<-connected, "1")
+
+		server.receive <- &cs.Request{Cmd: "boom"}
+		<-server.written
+		t.Assert(<-panics, "boom")
+
+		srv.WriteError("1", &cs.Response{Cmd: "notice"}, cs.ErrQueueFull)
+		t.Assert(<-pushErrs, cs.ErrQueueFull)
+
+		server.receive <- &cs.Request{Cmd: "bye"}
+		t.Assert(<-closed, cs.CloseReasonServer)
+	})
+}
+
+func TestSrv_OnCloseRemote(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		closed := make(chan cs.CloseReason, 1)
+		srv.OnClose(func(sid string, reason cs.CloseReason) {
+			closed <- reason
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: cs.CmdConnected}
+		server.receive <- &cs.Request{Cmd: cs.CmdClosed}
+		t.Assert(<-closed, cs.CloseReasonRemote)
+	})
+}
+
+func TestSrv_OnAdapterError(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := &errAdapter{newChanAdapter()}
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetLogger(cs.NopLogger)
+		var got error
+		srv.OnAdapterError(func(s cs.ServerAdapter, err error) {
+			got = err
+		})
+		err := srv.Run()
+		t.Assert(err.Error(), "read failed")
+		t.Assert(got, err)
+	})
+}
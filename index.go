@@ -0,0 +1,103 @@
+package cs
+
+import (
+	"sort"
+	"sync"
+)
+
+// 会话 SID 与 key 的多对多双向索引，如房间和会话，用户和会话
+type sidIndex struct {
+	mu   sync.RWMutex
+	keys map[string]map[string]struct{} // key => sids
+	sids map[string]map[string]struct{} // sid => keys
+}
+
+func newSidIndex() *sidIndex {
+	return &sidIndex{
+		keys: map[string]map[string]struct{}{},
+		sids: map[string]map[string]struct{}{},
+	}
+}
+
+// 增加关联
+func (x *sidIndex) add(key, sid string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	indexAdd(x.keys, key, sid)
+	indexAdd(x.sids, sid, key)
+}
+
+// 替换 sid 的所有关联为 key
+func (x *sidIndex) set(key, sid string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for old := range x.sids[sid] {
+		indexRemove(x.keys, old, sid)
+	}
+	delete(x.sids, sid)
+	indexAdd(x.keys, key, sid)
+	indexAdd(x.sids, sid, key)
+}
+
+// 删除关联
+func (x *sidIndex) remove(key, sid string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	indexRemove(x.keys, key, sid)
+	indexRemove(x.sids, sid, key)
+}
+
+// 删除 sid 的所有关联，返回被删除的 key
+func (x *sidIndex) removeSid(sid string) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	keys := sortedKeys(x.sids[sid])
+	for _, key := range keys {
+		indexRemove(x.keys, key, sid)
+	}
+	delete(x.sids, sid)
+	return keys
+}
+
+// key 关联的所有 sid
+func (x *sidIndex) sidsOf(key string) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return sortedKeys(x.keys[key])
+}
+
+// sid 关联的所有 key
+func (x *sidIndex) keysOf(sid string) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return sortedKeys(x.sids[sid])
+}
+
+func indexAdd(m map[string]map[string]struct{}, a, b string) {
+	set, ok := m[a]
+	if !ok {
+		set = map[string]struct{}{}
+		m[a] = set
+	}
+	set[b] = struct{}{}
+}
+
+func indexRemove(m map[string]map[string]struct{}, a, b string) {
+	set, ok := m[a]
+	if !ok {
+		return
+	}
+	delete(set, b)
+	if len(set) == 0 {
+		delete(m, a)
+	}
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,406 @@
+package cs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 支持的 JWT 签名算法
+const (
+	JWTHS256 = "HS256"
+	JWTRS256 = "RS256"
+	JWTES256 = "ES256"
+)
+
+// JWT 验证的错误
+var (
+	ErrJWTMalformed   = errors.New("cs: malformed jwt")
+	ErrJWTAlgorithm   = errors.New("cs: unsupported jwt algorithm")
+	ErrJWTSignature   = errors.New("cs: invalid jwt signature")
+	ErrJWTExpired     = errors.New("cs: jwt is expired")
+	ErrJWTNotValidYet = errors.New("cs: jwt is not valid yet")
+	ErrJWTClaims      = errors.New("cs: invalid jwt issuer or audience")
+)
+
+// 会话状态中保存 JWT 的 key
+const (
+	jwtTokenKey  = "cs.jwt.token"
+	jwtClaimsKey = "cs.jwt.claims"
+)
+
+// JWTKeyFunc 根据 JWT 头部的算法和 kid 返回验证签名的密钥
+// HS256 的密钥为 []byte 或者 string，RS256 为 *rsa.PublicKey，ES256 为 P-256 曲线的 *ecdsa.PublicKey
+type JWTKeyFunc func(alg, kid string) (interface{}, error)
+
+// JWTKey 所有 JWT 都使用同一个密钥验证
+func JWTKey(key interface{}) JWTKeyFunc {
+	return func(alg, kid string) (interface{}, error) {
+		return key, nil
+	}
+}
+
+// JWTKeySet 根据 JWT 头部的 kid 选择密钥，可以用于密钥轮换
+func JWTKeySet(keys map[string]interface{}) JWTKeyFunc {
+	return func(alg, kid string) (interface{}, error) {
+		if key, ok := keys[kid]; ok {
+			return key, nil
+		}
+		return nil, errors.New("cs: unknown jwt key id " + kid)
+	}
+}
+
+// JWTClaims JWT 的载荷
+type JWTClaims map[string]interface{}
+
+// Subject sub 字段
+func (c JWTClaims) Subject() string {
+	s, _ := c["sub"].(string)
+	return s
+}
+
+// ExpiresAt exp 字段，没有该字段时返回零值
+func (c JWTClaims) ExpiresAt() time.Time {
+	return c.time("exp")
+}
+
+func (c JWTClaims) time(name string) time.Time {
+	if v, ok := c[name].(float64); ok {
+		return time.Unix(int64(v), 0)
+	}
+	return time.Time{}
+}
+
+// 是否包含受众 aud，aud 字段可以是字符串或者字符串数组
+func (c JWTClaims) hasAudience(aud string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if a == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseJWT 验证 JWT 的签名和有效期，返回载荷，支持 HS256, RS256, ES256
+func ParseJWT(token string, keyFunc JWTKeyFunc) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+	key, err := keyFunc(header.Alg, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWT(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	claims := JWTClaims{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if exp := claims.ExpiresAt(); !exp.IsZero() && !now.Before(exp) {
+		return nil, ErrJWTExpired
+	}
+	if nbf := claims.time("nbf"); !nbf.IsZero() && now.Before(nbf) {
+		return nil, ErrJWTNotValidYet
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	bt, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrJWTMalformed
+	}
+	if err := json.Unmarshal(bt, v); err != nil {
+		return ErrJWTMalformed
+	}
+	return nil
+}
+
+// 验证签名
+func verifyJWT(alg string, key interface{}, signed string, sig []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+	switch alg {
+	case JWTHS256:
+		var secret []byte
+		switch k := key.(type) {
+		case []byte:
+			secret = k
+		case string:
+			secret = []byte(k)
+		default:
+			return ErrJWTAlgorithm
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrJWTSignature
+		}
+		return nil
+	case JWTRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrJWTAlgorithm
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) != nil {
+			return ErrJWTSignature
+		}
+		return nil
+	case JWTES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() {
+			return ErrJWTAlgorithm
+		}
+		if len(sig) != 64 {
+			return ErrJWTSignature
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return ErrJWTSignature
+		}
+		return nil
+	}
+	return ErrJWTAlgorithm
+}
+
+// JWTExpirePolicy 会话的 JWT 过期后的处理策略
+type JWTExpirePolicy int
+
+const (
+	// JWTExpireReject 拒绝会话的命令，直到通过刷新命令更换新的 JWT
+	JWTExpireReject JWTExpirePolicy = iota
+	// JWTExpireClose JWT 过期时关闭会话
+	JWTExpireClose
+)
+
+// JWTConfig JWT 认证中间件的配置
+type JWTConfig struct {
+	Key        JWTKeyFunc      // 验证签名的密钥，必填
+	LoginCmd   string          // 登录命令，请求数据为 {"token": "..."}，默认为 "auth.login"
+	RefreshCmd string          // 刷新命令，请求数据和登录命令一样，新 JWT 的 sub 必须和当前的一致，默认为 "auth.refresh"
+	Query      string          // websocket 升级请求中 JWT 的查询参数，默认为 "token"
+	Header     string          // HTTP 请求中 JWT 的请求头，值的格式为 "Bearer <token>"，默认为 "Authorization"
+	Skip       []string        // 不需要认证的命令，支持和路由一样的模式
+	Expire     JWTExpirePolicy // JWT 过期后的处理策略，默认为 JWTExpireReject
+	Issuer     string          // 不为空时要求 iss 一致
+	Audience   string          // 不为空时要求 aud 包含该值
+	BindUser   bool            // 认证通过后将会话绑定到 sub 用户
+	Code       int             // 认证失败的响应码，默认为 CodeUnauthorized
+}
+
+// JWTAuth JWT 认证中间件，JWT 可以来自登录命令，websocket 升级请求的查询参数，或者 xhttp 请求的 Authorization 请求头
+// 验证通过后载荷保存在会话状态中，通过 c.JWTClaims() 获取，未认证和过期的会话的命令响应 Code
+// 内置命令和 Skip 中的命令不需要认证
+// srv.Use(cs.JWTAuth(cs.JWTConfig{Key: cs.JWTKey([]byte("secret")), Expire: cs.JWTExpireClose}))
+func JWTAuth(conf JWTConfig) HandlerFunc {
+	if conf.LoginCmd == "" {
+		conf.LoginCmd = "auth.login"
+	}
+	if conf.RefreshCmd == "" {
+		conf.RefreshCmd = "auth.refresh"
+	}
+	if conf.Query == "" {
+		conf.Query = "token"
+	}
+	if conf.Header == "" {
+		conf.Header = "Authorization"
+	}
+	if conf.Code == 0 {
+		conf.Code = CodeUnauthorized
+	}
+	skip := newRouter()
+	for _, cmd := range conf.Skip {
+		skip.add(cmd, &registration{})
+	}
+	j := &jwtAuth{conf: conf, timers: map[string]*time.Timer{}}
+	var hookOnce sync.Once
+
+	return func(c *Context) {
+		hookOnce.Do(func() {
+			c.Srv.onClose(j.removeSid)
+		})
+		switch c.Cmd {
+		case CmdClosed, CmdHeartbeat:
+			c.Next()
+			return
+		case conf.LoginCmd, conf.RefreshCmd:
+			c.Abort()
+			j.handleToken(c)
+			return
+		}
+		err := j.loadCredentials(c)
+		if rt, _ := skip.match(c.Cmd); rt != nil || isInternalCmd(c.Cmd) {
+			c.Next()
+			return
+		}
+		if err == nil {
+			err = j.check(c)
+		}
+		if err != nil {
+			c.Abort()
+			c.Resp(conf.Code, err.Error(), struct{}{})
+			return
+		}
+		c.Next()
+	}
+}
+
+type jwtAuth struct {
+	conf   JWTConfig
+	mu     sync.Mutex
+	timers map[string]*time.Timer // JWTExpireClose 策略下会话过期时关闭会话的定时器
+}
+
+// 处理登录和刷新命令
+func (j *jwtAuth) handleToken(c *Context) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(c.RawData, &body); err != nil || body.Token == "" {
+		c.Resp(CodeBadRequest, "token is required", struct{}{})
+		return
+	}
+	old := c.JWTClaims()
+	if c.Cmd == j.conf.RefreshCmd && old == nil {
+		c.Resp(j.conf.Code, msgUnauthorized, struct{}{})
+		return
+	}
+	claims, err := j.parse(body.Token)
+	if err == nil && c.Cmd == j.conf.RefreshCmd && claims.Subject() != old.Subject() {
+		err = ErrJWTClaims
+	}
+	if err != nil {
+		c.Resp(j.conf.Code, err.Error(), struct{}{})
+		return
+	}
+	j.store(c, body.Token, claims)
+	c.OK(claims)
+}
+
+// 读取认证信息中的 JWT
+// 本次请求自带的认证信息(如 HTTP 的命令请求)和会话保存的 JWT 不同时重新解析并保存
+// 适配器提供的会话认证信息只在会话还没有 JWT 时读取，避免连接时的 JWT 覆盖登录或者刷新命令更换的 JWT
+func (j *jwtAuth) loadCredentials(c *Context) error {
+	stored := c.Get(jwtTokenKey)
+	if stored != nil && c.cred == nil {
+		return nil
+	}
+	cred := c.credentials()
+	if cred == nil {
+		return nil
+	}
+	token := cred.Query.Get(j.conf.Query)
+	if auth := cred.Header.Get(j.conf.Header); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" || token == stored {
+		return nil
+	}
+	claims, err := j.parse(token)
+	if err != nil {
+		return err
+	}
+	j.store(c, token, claims)
+	return nil
+}
+
+// 检查会话是否已认证并且没有过期
+func (j *jwtAuth) check(c *Context) error {
+	claims := c.JWTClaims()
+	if claims == nil {
+		return errors.New(msgUnauthorized)
+	}
+	if exp := claims.ExpiresAt(); !exp.IsZero() && !time.Now().Before(exp) {
+		if j.conf.Expire == JWTExpireClose {
+			go c.Srv.closeWithReason(c.Server, c.SID, CloseReasonUnauthorized)
+		}
+		return ErrJWTExpired
+	}
+	return nil
+}
+
+func (j *jwtAuth) parse(token string) (JWTClaims, error) {
+	claims, err := ParseJWT(token, j.conf.Key)
+	if err != nil {
+		return nil, err
+	}
+	if j.conf.Issuer != "" && claims["iss"] != j.conf.Issuer {
+		return nil, ErrJWTClaims
+	}
+	if j.conf.Audience != "" && !claims.hasAudience(j.conf.Audience) {
+		return nil, ErrJWTClaims
+	}
+	return claims, nil
+}
+
+// 保存会话的 JWT，JWTExpireClose 策略下重置过期关闭会话的定时器
+func (j *jwtAuth) store(c *Context, token string, claims JWTClaims) {
+	c.Set(jwtTokenKey, token)
+	c.Set(jwtClaimsKey, claims)
+	if j.conf.BindUser && claims.Subject() != "" {
+		c.BindUser(claims.Subject())
+	}
+	if j.conf.Expire != JWTExpireClose {
+		return
+	}
+	exp := claims.ExpiresAt()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if t, ok := j.timers[c.SID]; ok {
+		t.Stop()
+		delete(j.timers, c.SID)
+	}
+	if exp.IsZero() {
+		return
+	}
+	srv, server, sid := c.Srv, c.Server, c.SID
+	j.timers[sid] = time.AfterFunc(time.Until(exp), func() {
+		srv.closeWithReason(server, sid, CloseReasonUnauthorized)
+	})
+}
+
+// 会话关闭时清理定时器
+func (j *jwtAuth) removeSid(sid string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if t, ok := j.timers[sid]; ok {
+		t.Stop()
+		delete(j.timers, sid)
+	}
+}
+
+// JWTClaims 当前会话通过 JWTAuth 认证的 JWT 载荷，未认证时返回 nil
+func (c *Context) JWTClaims() JWTClaims {
+	claims, _ := c.Get(jwtClaimsKey).(JWTClaims)
+	return claims
+}
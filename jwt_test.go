@@ -0,0 +1,198 @@
+package cs_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+// 生成测试用的 JWT
+func signJWT(alg string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch alg {
+	case cs.JWTHS256:
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case cs.JWTRS256:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, hash[:])
+	case cs.JWTES256:
+		r, s, _ := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), hash[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestParseJWT(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		secret := []byte("secret")
+		rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		exp := float64(time.Now().Add(time.Hour).Unix())
+		claims := map[string]interface{}{"sub": "u1", "exp": exp}
+
+		for _, c := range []struct {
+			alg      string
+			signKey  interface{}
+			checkKey interface{}
+		}{
+			{cs.JWTHS256, secret, secret},
+			{cs.JWTRS256, rsaKey, &rsaKey.PublicKey},
+			{cs.JWTES256, ecKey, &ecKey.PublicKey},
+		} {
+			token := signJWT(c.alg, c.signKey, claims)
+			parsed, err := cs.ParseJWT(token, cs.JWTKey(c.checkKey))
+			t.Assert(err, nil)
+			t.Assert(parsed.Subject(), "u1")
+			t.Assert(parsed.ExpiresAt().Unix(), int64(exp))
+		}
+
+		_, err := cs.ParseJWT(signJWT(cs.JWTHS256, []byte("other"), claims), cs.JWTKey(secret))
+		t.Assert(err, cs.ErrJWTSignature)
+		_, err = cs.ParseJWT(signJWT(cs.JWTHS256, secret, claims), cs.JWTKey(&rsaKey.PublicKey))
+		t.Assert(err, cs.ErrJWTAlgorithm)
+		_, err = cs.ParseJWT(signJWT(cs.JWTHS256, secret, map[string]interface{}{"exp": 1}), cs.JWTKey(secret))
+		t.Assert(err, cs.ErrJWTExpired)
+		_, err = cs.ParseJWT("abc", cs.JWTKey(secret))
+		t.Assert(err, cs.ErrJWTMalformed)
+	})
+}
+
+func TestJWTAuth(t *testing.T) {
+	secret := []byte("secret")
+	token := func(sub string, ttl time.Duration) json.RawMessage {
+		bt, _ := json.Marshal(map[string]string{
+			"token": signJWT(cs.JWTHS256, secret, map[string]interface{}{"sub": sub, "exp": time.Now().Add(ttl).Unix()}),
+		})
+		return bt
+	}
+	newSrv := func(policy cs.JWTExpirePolicy) (*cs.Srv, *chanAdapter) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.Use(cs.JWTAuth(cs.JWTConfig{
+			Key:      cs.JWTKey(secret),
+			Skip:     []string{"public.*"},
+			Expire:   policy,
+			BindUser: true,
+		}))
+		srv.Handle("ping", func(c *cs.Context) {
+			c.OK(c.JWTClaims().Subject())
+		})
+		srv.Handle("public.info", func(c *cs.Context) {})
+		go srv.Run()
+		return srv, server
+	}
+
+	// 登录，刷新和过期拒绝请求
+	gtest.C(t, func(t *gtest.T) {
+		srv, server := newSrv(cs.JWTExpireReject)
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "ping"}
+		t.Assert((<-server.written).Code, cs.CodeUnauthorized)
+		server.receive <- &cs.Request{Cmd: "public.info"}
+		t.Assert((<-server.written).Code, 0)
+
+		server.receive <- &cs.Request{Cmd: "auth.login", RawData: token("u1", 2*time.Second)}
+		t.Assert((<-server.written).Code, 0)
+		server.receive <- &cs.Request{Cmd: "ping"}
+		resp := <-server.written
+		t.Assert(resp.Code, 0)
+		t.Assert(resp.Data, "u1")
+		t.Assert(srv.UserID("1"), "u1")
+
+		// 刷新的 JWT 必须是同一个用户
+		server.receive <- &cs.Request{Cmd: "auth.refresh", RawData: token("u2", time.Hour)}
+		t.Assert((<-server.written).Code, cs.CodeUnauthorized)
+
+		time.Sleep(2 * time.Second)
+		server.receive <- &cs.Request{Cmd: "ping"}
+		resp = <-server.written
+		t.Assert(resp.Code, cs.CodeUnauthorized)
+		t.Assert(resp.Msg, cs.ErrJWTExpired.Error())
+
+		server.receive <- &cs.Request{Cmd: "auth.refresh", RawData: token("u1", time.Hour)}
+		t.Assert((<-server.written).Code, 0)
+		server.receive <- &cs.Request{Cmd: "ping"}
+		t.Assert((<-server.written).Code, 0)
+	})
+
+	// 过期时关闭会话
+	gtest.C(t, func(t *gtest.T) {
+		srv, server := newSrv(cs.JWTExpireClose)
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "auth.login", RawData: token("u1", 2*time.Second)}
+		t.Assert((<-server.written).Code, 0)
+		time.Sleep(2100 * time.Millisecond)
+		t.Assert(server.GetAllSID(), []string{})
+	})
+}
+
+type credAdapter struct {
+	*chanAdapter
+	cred *cs.Credentials
+}
+
+func (a *credAdapter) Credentials(sid string) *cs.Credentials {
+	return a.cred
+}
+
+func TestJWTAuth_RefreshQueryToken(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		secret := []byte("secret")
+		sign := func(ttl time.Duration) string {
+			return signJWT(cs.JWTHS256, secret, map[string]interface{}{"sub": "u1", "exp": time.Now().Add(ttl).Unix()})
+		}
+		server := &credAdapter{newChanAdapter("1"), &cs.Credentials{
+			Header: http.Header{},
+			Query:  url.Values{"token": {sign(2 * time.Second)}},
+		}}
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.Use(cs.JWTAuth(cs.JWTConfig{Key: cs.JWTKey(secret)}))
+		srv.Handle("ping", func(c *cs.Context) {
+			c.OK(c.JWTClaims().Subject())
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: cs.CmdConnected}
+		server.receive <- &cs.Request{Cmd: "ping"}
+		t.Assert((<-server.written).Code, 0)
+
+		refresh, _ := json.Marshal(map[string]string{"token": sign(time.Hour)})
+		server.receive <- &cs.Request{Cmd: "auth.refresh", RawData: refresh}
+		t.Assert((<-server.written).Code, 0)
+
+		// 连接时的 JWT 过期后，刷新的 JWT 仍然有效
+		time.Sleep(2 * time.Second)
+		server.receive <- &cs.Request{Cmd: "ping"}
+		resp := <-server.written
+		t.Assert(resp.Code, 0)
+		t.Assert(resp.Data, "u1")
+	})
+}
@@ -0,0 +1,22 @@
+//go:build go1.21
+
+package cs
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLogger 把 log/slog 的日志适配为 Logger
+// srv.SetLogger(cs.SlogLogger(slog.Default()))
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (l slogLogger) Log(level LogLevel, msg string, kv ...interface{}) {
+	l.l.Log(context.Background(), slog.Level(level), msg, kv...)
+}
@@ -0,0 +1,24 @@
+//go:build go1.21
+
+package cs_test
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+func TestSlogLogger(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		buf := bytes.NewBuffer(nil)
+		logger := cs.SlogLogger(slog.New(slog.NewTextHandler(buf, nil)))
+		logger.Log(cs.LevelDebug, "hidden")
+		logger.Log(cs.LevelWarn, "push failed", "sid", "1")
+		t.Assert(strings.Contains(buf.String(), "hidden"), false)
+		t.Assert(strings.Contains(buf.String(), `level=WARN msg="push failed" sid=1`), true)
+	})
+}
@@ -3,20 +3,119 @@ package cs
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-type printLogger interface {
-	Debug(...interface{})
+// LogLevel 日志级别
+type LogLevel int
+
+// 日志级别，数值和 log/slog 的级别一致
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Logger 结构化日志接口，kv 为键值对，如 logger.Log(cs.LevelWarn, "decode message failed", "sid", sid, "error", err)
+// 框架和适配器的连接错误、消息解码失败、panic、推送失败等都通过它输出
+type Logger interface {
+	Log(level LogLevel, msg string, kv ...interface{})
+}
+
+// NopLogger 不输出任何日志，可以用于在测试中关闭日志
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(level LogLevel, msg string, kv ...interface{}) {}
+
+// NewTextLogger 创建文本格式的日志，只输出大于等于 level 的日志，每行的格式为
+// 2006/01/02 15:04:05 WARN decode message failed sid=ws.1 error="invalid character"
+func NewTextLogger(w io.Writer, level LogLevel) Logger {
+	return &textLogger{w: w, level: level}
+}
+
+type textLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level LogLevel
+}
+
+func (l *textLogger) Log(level LogLevel, msg string, kv ...interface{}) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(time.Now().Format("2006/01/02 15:04:05"))
+	b.WriteByte(' ')
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+		if i+1 < len(kv) {
+			b.WriteString(logValue(kv[i+1]))
+		}
+	}
+	b.WriteByte('\n')
+	l.mu.Lock()
+	io.WriteString(l.w, b.String())
+	l.mu.Unlock()
 }
 
-type consoleLogger struct{}
+// 日志中的值，包含空白或者引号时加上引号
+func logValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// 默认的日志，输出 INFO 及以上级别到标准错误
+var defaultLogger = NewTextLogger(os.Stderr, LevelInfo)
+
+// SetLogger 设置日志，默认输出 INFO 及以上级别到标准错误，设置为 nil 或者 cs.NopLogger 则不输出
+// 没有单独设置日志的适配器也会使用该日志
+func (s *Srv) SetLogger(l Logger) *Srv {
+	if l == nil {
+		l = NopLogger
+	}
+	s.logger = l
+	return s
+}
 
-func (consoleLogger) Debug(a ...interface{}) {
-	fmt.Println(a...)
+// Logger 获取日志
+func (s *Srv) Logger() Logger {
+	return s.logger
 }
 
-const loggerCtxKey = "__logger_middleware_instence__"
-const loggerNameCtxKey = "__logger_middleware_name__"
+// 旧版 AccessLogger 的日志接口，每条日志是一行文本
+type printLogger interface {
+	Debug(...interface{})
+}
 
 func getLogDataString(v interface{}) string {
 	data := ""
@@ -34,34 +133,68 @@ func getLogDataString(v interface{}) string {
 	return data
 }
 
-// AccessLogger 打印请求响应中间件
-// 2 个可选参数，如果参数是 printLogger 接口类型则用于设置打印日志的 Logger 实例，如果是 string 类型则用于设置日志前缀
+// 日志中的 trace id，没有时为空
+func logTrace(c *Context) string {
+	if id := c.TraceID(); id != "" {
+		return " TRACE=" + id
+	}
+	return ""
+}
+
+// AccessLogger 打印请求响应中间件，请求带有 trace 或者设置了 Tracer 时会打印 trace id
+// 需要记录耗时、数据大小或者输出 JSON 格式时使用 AccessLog
+// 可选参数，如果参数是 cs.Logger 则用于设置打印日志的实例，默认使用 Srv 的日志，如果是 string 类型则用于设置日志前缀
+// 兼容旧版只有 Debug(...interface{}) 方法的日志实例，每条日志格式化为一行文本
 // AccessLogger("MySRV") 设置名称
 // AccessLogger("MySRV", logger) 设置名称和打日志的实例
 // AccessLogger(logger, "MySRV") 设置名称和打日志的实例
 // AccessLogger(logger) 设置打日志的实例
 // AccessLogger(123) 无效参数，不会产生异常，等价于没有参数
 func (s *Srv) AccessLogger(args ...interface{}) HandlerFunc {
-	var logger printLogger = consoleLogger{}
+	var logger Logger
+	var legacy printLogger
 	name := "SRV"
 	for _, v := range args {
-		if n, ok := v.(string); ok {
-			name = n
-		} else if l, ok := v.(printLogger); ok {
+		switch l := v.(type) {
+		case string:
+			name = l
+		case Logger:
 			logger = l
+		case printLogger:
+			legacy = l
+		}
+	}
+
+	// 输出一条访问日志
+	access := func(c *Context, event string, withSeq bool, data string) {
+		if legacy != nil {
+			line := fmt.Sprintf("%s %s SID=%s CMD=%s", name, event, c.SID, c.Cmd)
+			if withSeq {
+				line += " SEQ=" + c.Seqno
+			}
+			legacy.Debug(line + logTrace(c) + " " + data)
+			return
+		}
+		l := logger
+		if l == nil {
+			l = c.Srv.Logger()
+		}
+		kv := []interface{}{"sid", c.SID, "cmd", c.Cmd}
+		if withSeq {
+			kv = append(kv, "seqno", c.Seqno)
 		}
+		if id := c.TraceID(); id != "" {
+			kv = append(kv, "trace", id)
+		}
+		l.Log(LevelInfo, name+" "+event, append(kv, "data", data)...)
 	}
 
 	s.UsePush(func(c *Context) error {
-		logger.Debug(fmt.Sprintf("%s PUSH SID=%s CMD=%s %s", name, c.SID, c.Cmd, getLogDataString(c.Data)))
+		access(c, "PUSH", false, getLogDataString(c.Data))
 		return nil
 	})
 
 	return func(c *Context) {
-		if c.Get(loggerCtxKey) == nil {
-			c.Set(loggerCtxKey, logger)
-			c.Set(loggerNameCtxKey, name)
-		}
 		if (c.Cmd == CmdConnected ||
 			c.Cmd == CmdClosed ||
 			c.Cmd == CmdHeartbeat) &&
@@ -69,8 +202,8 @@ func (s *Srv) AccessLogger(args ...interface{}) HandlerFunc {
 			c.Next()
 			return
 		}
-		logger.Debug(fmt.Sprintf("%s RECV SID=%s CMD=%s SEQ=%s %s", name, c.SID, c.Cmd, c.Seqno, string(c.RawData)))
+		access(c, "RECV", true, string(c.RawData))
 		c.Next()
-		logger.Debug(fmt.Sprintf("%s RESP SID=%s CMD=%s SEQ=%s %s", name, c.SID, c.Cmd, c.Seqno, getLogDataString(c.Data)))
+		access(c, "RESP", true, getLogDataString(c.Data))
 	}
 }
@@ -0,0 +1,82 @@
+package cs_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+type logEntry struct {
+	level cs.LogLevel
+	msg   string
+	kv    []interface{}
+}
+
+type captureLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *captureLogger) Log(level cs.LogLevel, msg string, kv ...interface{}) {
+	l.mu.Lock()
+	l.entries = append(l.entries, logEntry{level, msg, kv})
+	l.mu.Unlock()
+}
+
+func (l *captureLogger) find(msg string) *logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.entries {
+		if l.entries[i].msg == msg {
+			return &l.entries[i]
+		}
+	}
+	return nil
+}
+
+func TestTextLogger(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		buf := bytes.NewBuffer(nil)
+		logger := cs.NewTextLogger(buf, cs.LevelInfo)
+		logger.Log(cs.LevelDebug, "hidden", "sid", "1")
+		logger.Log(cs.LevelWarn, "decode message failed", "sid", "ws.1", "error", `bad "json"`)
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		t.Assert(len(lines), 1)
+		t.Assert(strings.HasSuffix(lines[0], ` WARN decode message failed sid=ws.1 error="bad \"json\""`), true)
+	})
+}
+
+func TestSrv_Logger(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		logger := &captureLogger{}
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetLogger(logger)
+		srv.Use(cs.Recover())
+		srv.Handle("boom", func(c *cs.Context) {
+			panic("boom")
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "boom"}
+		resp := <-server.written
+		t.Assert(resp.Code, cs.CodePanic)
+
+		entry := logger.find("handler panic")
+		t.AssertNE(entry, nil)
+		t.Assert(entry.level, cs.LevelError)
+		t.Assert(entry.kv[:6], []interface{}{"sid", "1", "cmd", "boom", "panic", "boom"})
+
+		srv.SetLogger(nil)
+		t.Assert(srv.Logger(), cs.NopLogger)
+	})
+}
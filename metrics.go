@@ -0,0 +1,361 @@
+package cs
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 每个指标的标签值组合数量上限，超出后记到标签值为 other 的组合
+// 避免客户端发送任意命令导致指标无限增长
+const maxMetricSeries = 1000
+
+// 处理函数耗时的直方图分桶，单位秒
+var metricDurationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// QueueAdapter 可选接口，适配器实现该接口后可以在监控指标中统计发送队列的长度
+// 实现该接口的适配器通过发送队列写入消息，写入的结果由队列通过 Srv.WriteError 统计
+type QueueAdapter interface {
+	// QueueLen 所有连接的发送队列中等待写入的消息数量
+	QueueLen() int
+}
+
+// Metrics 服务的监控指标，框架内部自动收集，不需要注册中间件
+// 实现了 http.Handler，以 Prometheus 文本格式输出指标，也可以通过 Publish 发布到 expvar
+// http.Handle("/metrics", srv.Metrics())
+type Metrics struct {
+	srv               *Srv
+	connections       *metricVec // 建立的连接数，按适配器
+	disconnections    *metricVec // 关闭的连接数，按适配器
+	received          *metricVec // 收到的消息数，按命令匹配到的路由，没有匹配到时为 unmatched
+	sent              *metricVec // 写入成功的消息数，按命令，回复请求的消息按匹配到的路由
+	responses         *metricVec // 响应码，按命令和响应码
+	duration          *metricVec // 处理函数耗时，按命令
+	pushErrors        *metricVec // 推送失败的消息数，标签和 sent 相同
+	heartbeatTimeouts *metricVec // 心跳超时关闭的会话数
+	all               []*metricVec
+}
+
+func newMetrics(srv *Srv) *Metrics {
+	m := &Metrics{
+		srv:               srv,
+		connections:       newMetricVec("cs_connections_total", "Connections opened.", "counter", "adapter"),
+		disconnections:    newMetricVec("cs_disconnections_total", "Connections closed.", "counter", "adapter"),
+		received:          newMetricVec("cs_messages_received_total", "Messages received from clients.", "counter", "cmd"),
+		sent:              newMetricVec("cs_messages_sent_total", "Messages written to adapters.", "counter", "cmd"),
+		responses:         newMetricVec("cs_responses_total", "Responses by code.", "counter", "cmd", "code"),
+		duration:          newMetricVec("cs_handler_duration_seconds", "Handler latency in seconds.", "histogram", "cmd"),
+		pushErrors:        newMetricVec("cs_push_errors_total", "Messages failed to write.", "counter", "cmd"),
+		heartbeatTimeouts: newMetricVec("cs_heartbeat_timeouts_total", "Sessions closed by heartbeat timeout.", "counter"),
+	}
+	m.all = []*metricVec{m.connections, m.disconnections, m.received, m.sent, m.responses, m.duration, m.pushErrors, m.heartbeatTimeouts}
+	return m
+}
+
+// Metrics 获取服务的监控指标
+func (s *Srv) Metrics() *Metrics {
+	return s.metrics
+}
+
+// ServeHTTP 实现 http.Handler，以 Prometheus 文本格式输出指标
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, v := range m.all {
+		v.writeText(bw)
+	}
+	for _, g := range m.gauges() {
+		writeMetricHeader(bw, g.name, g.help, g.typ)
+		for _, s := range g.series {
+			fmt.Fprintf(bw, "%s%s %s\n", g.name, formatLabels(g.labels, s.values), formatFloat(s.value))
+		}
+	}
+	bw.Flush()
+}
+
+// Publish 把指标发布到 expvar，name 不能和已发布的变量重复，否则会 panic
+// srv.Metrics().Publish("cs")
+func (m *Metrics) Publish(name string) {
+	expvar.Publish(name, expvar.Func(m.snapshot))
+}
+
+// 指标的快照，用于 expvar，标签值使用逗号连接
+func (m *Metrics) snapshot() interface{} {
+	snap := map[string]interface{}{}
+	for _, v := range m.all {
+		snap[v.name] = v.snapshot()
+	}
+	for _, g := range m.gauges() {
+		vals := map[string]float64{}
+		for _, s := range g.series {
+			vals[strings.Join(s.values, ",")] = s.value
+		}
+		snap[g.name] = vals
+	}
+	return snap
+}
+
+// 采集时计算的指标
+type gaugeFamily struct {
+	name   string
+	help   string
+	typ    string // gauge 或者 counter
+	labels []string
+	series []gaugeSeries
+}
+
+type gaugeSeries struct {
+	values []string
+	value  float64
+}
+
+func (m *Metrics) gauges() []gaugeFamily {
+	sessions := map[string]int{}
+	m.srv.RangeSession(func(sid string, server ServerAdapter) bool {
+		sessions[adapterName(server)]++
+		return true
+	})
+	active := gaugeFamily{name: "cs_connections", help: "Connections currently open.", typ: "gauge", labels: []string{"adapter"}}
+	queue := gaugeFamily{name: "cs_outbound_queue_depth", help: "Messages waiting in outbound queues.", typ: "gauge", labels: []string{"adapter"}}
+	m.srv.serverMu.Lock()
+	servers := append([]ServerAdapter{}, m.srv.Server...)
+	m.srv.serverMu.Unlock()
+	for _, server := range servers {
+		name := adapterName(server)
+		active.series = append(active.series, gaugeSeries{[]string{name}, float64(sessions[name])})
+		if qa, ok := server.(QueueAdapter); ok {
+			queue.series = append(queue.series, gaugeSeries{[]string{name}, float64(qa.QueueLen())})
+		}
+	}
+
+	stats := m.srv.DispatchStats()
+	dispatch := func(name, help, typ string, value float64) gaugeFamily {
+		return gaugeFamily{name: name, help: help, typ: typ, series: []gaugeSeries{{nil, value}}}
+	}
+	return []gaugeFamily{
+		active,
+		queue,
+		dispatch("cs_dispatch_running", "Handlers currently running.", "gauge", float64(stats.Running)),
+		dispatch("cs_dispatch_pending", "Messages waiting in dispatch queues.", "gauge", float64(stats.Pending)),
+		dispatch("cs_dispatch_overflow_total", "Messages rejected because dispatch queues are full.", "counter", float64(stats.Overflow)),
+		dispatch("cs_dispatch_shed_total", "Messages rejected by load shedding.", "counter", float64(stats.Shed)),
+	}
+}
+
+// 连接建立
+func (m *Metrics) connected(server ServerAdapter) {
+	m.connections.add(1, adapterName(server))
+}
+
+// 连接关闭
+func (m *Metrics) closed(server ServerAdapter) {
+	m.disconnections.add(1, adapterName(server))
+}
+
+// 收到一个消息
+func (m *Metrics) read(cmd string) {
+	m.received.add(1, m.routeCmd(cmd))
+}
+
+// 处理完一个消息
+func (m *Metrics) handled(cmd string, code int, d time.Duration) {
+	m.responses.add(1, cmd, strconv.Itoa(code))
+	m.duration.observe(d.Seconds(), cmd)
+}
+
+// 推送一个消息，err 为 nil 表示写入成功
+// 回复请求的消息使用匹配到的路由作为标签，避免客户端发送任意的命令导致指标无限增长，服务端主动推送的消息使用原始的命令
+func (m *Metrics) pushed(resp *Response, err error) {
+	cmd := resp.Cmd
+	if isReply(resp) {
+		cmd = m.routeCmd(cmd)
+	}
+	if err != nil {
+		m.pushErrors.add(1, cmd)
+		return
+	}
+	m.sent.add(1, cmd)
+}
+
+// 客户端消息的命令标签，和 Context.metricCmd 一样使用匹配到的路由
+func (m *Metrics) routeCmd(cmd string) string {
+	if rt, _ := m.srv.router.match(cmd); rt != nil {
+		return rt.cmd
+	}
+	return "unmatched"
+}
+
+// 是否为回复客户端请求的消息，推送中间件复制的上下文也带有请求，需要同时比较命令
+func isReply(resp *Response) bool {
+	return resp.Request != nil && resp.Request.Cmd == resp.Cmd
+}
+
+// 适配器的名称，用作指标的标签值
+func adapterName(server ServerAdapter) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", server), "*")
+}
+
+// 一个指标的所有标签值组合
+type metricVec struct {
+	name   string
+	help   string
+	typ    string // counter 或者 histogram
+	labels []string
+	series sync.Map // 标签值用 \xff 连接 => *int64 或者 *histogram
+	size   int32
+}
+
+func newMetricVec(name, help, typ string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: typ, labels: labels}
+}
+
+// 获取标签值组合对应的数据，不存在时创建
+func (v *metricVec) get(values []string) interface{} {
+	key := strings.Join(values, "\xff")
+	if s, ok := v.series.Load(key); ok {
+		return s
+	}
+	if atomic.LoadInt32(&v.size) >= maxMetricSeries {
+		other := make([]string, len(values))
+		for i := range other {
+			other[i] = "other"
+		}
+		key = strings.Join(other, "\xff")
+	}
+	var s interface{} = new(int64)
+	if v.typ == "histogram" {
+		s = &histogram{buckets: make([]uint64, len(metricDurationBuckets))}
+	}
+	s, loaded := v.series.LoadOrStore(key, s)
+	if !loaded {
+		atomic.AddInt32(&v.size, 1)
+	}
+	return s
+}
+
+func (v *metricVec) add(n int64, values ...string) {
+	atomic.AddInt64(v.get(values).(*int64), n)
+}
+
+func (v *metricVec) observe(f float64, values ...string) {
+	v.get(values).(*histogram).observe(f)
+}
+
+// 按标签值排序遍历
+func (v *metricVec) rangeSorted(f func(values []string, s interface{})) {
+	keys := []string{}
+	v.series.Range(func(key, _ interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	for _, key := range keys {
+		s, _ := v.series.Load(key)
+		var values []string
+		if len(v.labels) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+		f(values, s)
+	}
+}
+
+func (v *metricVec) writeText(w *bufio.Writer) {
+	writeMetricHeader(w, v.name, v.help, v.typ)
+	v.rangeSorted(func(values []string, s interface{}) {
+		labels := formatLabels(v.labels, values)
+		if v.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %d\n", v.name, labels, atomic.LoadInt64(s.(*int64)))
+			return
+		}
+		h := s.(*histogram).load()
+		bucketLabels := append(append([]string{}, v.labels...), "le")
+		for i, le := range metricDurationBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(bucketLabels, append(values, formatFloat(le))), h.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(bucketLabels, append(values, "+Inf")), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labels, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labels, h.count)
+	})
+}
+
+func (v *metricVec) snapshot() map[string]interface{} {
+	snap := map[string]interface{}{}
+	v.rangeSorted(func(values []string, s interface{}) {
+		key := strings.Join(values, ",")
+		if v.typ != "histogram" {
+			snap[key] = atomic.LoadInt64(s.(*int64))
+			return
+		}
+		h := s.(*histogram).load()
+		snap[key] = map[string]interface{}{"count": h.count, "sum": h.sum}
+	})
+	return snap
+}
+
+// 直方图，buckets 是每个分桶的累计数量
+type histogram struct {
+	mu      sync.Mutex
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(f float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range metricDurationBuckets {
+		if f <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += f
+}
+
+// 复制一份数据
+func (h *histogram) load() histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return histogram{buckets: append([]uint64{}, h.buckets...), count: h.count, sum: h.sum}
+}
+
+func writeMetricHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// 格式化标签，如 {cmd="login",code="0"}
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,93 @@
+package cs_test
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+func TestSrv_Metrics(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.Handle("room.:id.join", func(c *cs.Context) {})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: cs.CmdConnected}
+		server.receive <- &cs.Request{Cmd: "room.1.join"}
+		<-server.written
+		server.receive <- &cs.Request{Cmd: "room.2.join"}
+		<-server.written
+		server.receive <- &cs.Request{Cmd: "unknown"}
+		<-server.written
+
+		w := httptest.NewRecorder()
+		srv.Metrics().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		body := w.Body.String()
+		for _, line := range []string{
+			"# TYPE cs_messages_received_total counter",
+			`cs_connections{adapter="cs_test.chanAdapter"} 1`,
+			`cs_connections_total{adapter="cs_test.chanAdapter"} 1`,
+			`cs_messages_received_total{cmd="room.:id.join"} 2`,
+			`cs_messages_received_total{cmd="unmatched"} 1`,
+			`cs_responses_total{cmd="room.:id.join",code="0"} 2`,
+			`cs_responses_total{cmd="unmatched",code="-1"} 1`,
+			`cs_handler_duration_seconds_bucket{cmd="room.:id.join",le="+Inf"} 2`,
+			`cs_handler_duration_seconds_count{cmd="room.:id.join"} 2`,
+			`cs_messages_sent_total{cmd="room.:id.join"} 2`,
+			`cs_messages_sent_total{cmd="unmatched"} 1`,
+			"cs_dispatch_running 0",
+		} {
+			t.Assert(strings.Contains(body, line+"\n"), true)
+		}
+
+		name := fmt.Sprintf("cs_test_metrics_%p", srv)
+		srv.Metrics().Publish(name)
+		t.Assert(strings.Contains(expvar.Get(name).String(), `"cs_messages_received_total":{"room.:id.join":2`), true)
+	})
+	// 被调度器拒绝的消息也统计收到，服务端主动推送的消息使用原始的命令
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetDispatch(cs.DispatchConfig{Workers: 2, MaxInFlight: 1, Shed: true})
+		release := make(chan struct{})
+		srv.Handle("slow", func(c *cs.Context) {
+			<-release
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: cs.CmdConnected}
+		server.receive <- &cs.Request{Cmd: "slow", Seqno: "1"}
+		time.Sleep(10 * time.Millisecond)
+		server.receive <- &cs.Request{Cmd: "slow", Seqno: "2"}
+		t.Assert((<-server.written).Code, cs.CodeBusy)
+		t.Assert(srv.Push("1", &cs.Response{Cmd: "notice.1"}), nil)
+		<-server.written
+		close(release)
+		<-server.written
+
+		w := httptest.NewRecorder()
+		srv.Metrics().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		body := w.Body.String()
+		for _, line := range []string{
+			`cs_messages_received_total{cmd="slow"} 2`,
+			`cs_messages_sent_total{cmd="slow"} 2`,
+			`cs_messages_sent_total{cmd="notice.1"} 1`,
+		} {
+			t.Assert(strings.Contains(body, line+"\n"), true)
+		}
+	})
+}
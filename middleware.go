@@ -15,6 +15,7 @@ func internalPanicHandler(c *Context) {
 	defer func() {
 		if data := recover(); data != nil {
 			if _, ok := data.(internalPanic); !ok {
+				c.Srv.panicked(c, data)
 				panic(data)
 			}
 		}
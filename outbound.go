@@ -0,0 +1,253 @@
+package cs
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// 发送队列的错误
+var (
+	ErrQueueFull    = errors.New("cs: outbound queue is full")              // 队列已满，新的消息被丢弃
+	ErrQueueDropped = errors.New("cs: message dropped from outbound queue") // 队列已满，最旧的消息被丢弃
+	ErrSlowConsumer = errors.New("cs: slow consumer disconnected")          // 队列已满，连接被断开
+	ErrQueueClosed  = errors.New("cs: outbound queue is closed")            // 连接已关闭
+)
+
+// QueuePolicy 发送队列满了之后的处理策略
+type QueuePolicy int
+
+const (
+	// QueueBlock 等待队列有空位，最多等待 BlockTimeout，超时后丢弃新的消息
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest 丢弃队列中最旧的消息
+	QueueDropOldest
+	// QueueDropNewest 丢弃新的消息
+	QueueDropNewest
+	// QueueDisconnect 断开消费太慢的连接
+	QueueDisconnect
+)
+
+// 发送队列的默认配置
+const (
+	defaultQueueSize         = 256
+	defaultQueueBlockTimeout = 5 * time.Second
+	defaultQueueFlushTimeout = time.Second
+)
+
+// QueueConfig 连接发送队列的配置
+type QueueConfig struct {
+	Size         int           // 队列长度，默认为 256
+	Policy       QueuePolicy   // 队列满了之后的处理策略，默认为 QueueBlock
+	BlockTimeout time.Duration // QueueBlock 策略的最长等待时间，默认为 5 秒
+	WriteTimeout time.Duration // 每个消息写入连接的超时时长，默认为 0 不限制
+}
+
+// OutboundQueue 连接的发送队列，推送的消息先放入队列，由单独的 goroutine 依次写入连接
+// 推送方不会被消费慢的连接阻塞，写入的结果通过 report 通知，适配器一般交给 Srv.WriteError 处理
+// 应该在实现 adapter 时才有用
+type OutboundQueue struct {
+	conf       QueueConfig
+	ch         chan *Response
+	write      func(resp *Response, deadline time.Time) error
+	report     func(resp *Response, err error)
+	disconnect func()
+	mu         sync.RWMutex // Push 放入消息时持有读锁，保证队列关闭后不会再有新的消息
+	closed     chan struct{}
+	closeOnce  sync.Once
+	done       chan struct{} // 写入的 goroutine 已退出
+}
+
+// NewOutboundQueue 创建发送队列并启动写入的 goroutine
+// write 把消息写入连接，deadline 不为零值时应该设置为连接的写入超时
+// report 在消息写入连接后以 nil 调用，在消息被丢弃或写入失败时以对应的错误调用，可以为空
+// disconnect 在 QueueDisconnect 策略下断开连接，写入失败时也会调用，不能同步调用 Close 等待队列
+func NewOutboundQueue(conf QueueConfig, write func(resp *Response, deadline time.Time) error, report func(resp *Response, err error), disconnect func()) *OutboundQueue {
+	if conf.Size <= 0 {
+		conf.Size = defaultQueueSize
+	}
+	if conf.BlockTimeout <= 0 {
+		conf.BlockTimeout = defaultQueueBlockTimeout
+	}
+	q := &OutboundQueue{
+		conf:       conf,
+		ch:         make(chan *Response, conf.Size),
+		write:      write,
+		report:     report,
+		disconnect: disconnect,
+		closed:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Push 把消息放入队列，队列满了之后按照策略处理
+// 返回 nil 不代表消息已经写入连接，写入的错误通过 report 通知
+func (q *OutboundQueue) Push(resp *Response) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	select {
+	case <-q.closed:
+		return ErrQueueClosed
+	default:
+	}
+	select {
+	case q.ch <- resp:
+		return nil
+	default:
+	}
+
+	switch q.conf.Policy {
+	case QueueDropNewest:
+		q.fail(resp, ErrQueueFull)
+		return ErrQueueFull
+	case QueueDropOldest:
+		for {
+			select {
+			case q.ch <- resp:
+				return nil
+			default:
+			}
+			select {
+			case old := <-q.ch:
+				q.fail(old, ErrQueueDropped)
+			default:
+			}
+		}
+	case QueueDisconnect:
+		q.fail(resp, ErrSlowConsumer)
+		if q.disconnect != nil {
+			go q.disconnect()
+		}
+		return ErrSlowConsumer
+	}
+
+	timer := time.NewTimer(q.conf.BlockTimeout)
+	defer timer.Stop()
+	select {
+	case q.ch <- resp:
+		return nil
+	case <-timer.C:
+		q.fail(resp, ErrQueueFull)
+		return ErrQueueFull
+	case <-q.closed:
+		return ErrQueueClosed
+	}
+}
+
+// Close 关闭队列，不再接收新的消息，并等待队列中剩余的消息写入连接
+// 设置了 WriteTimeout 时每个消息最多等待 WriteTimeout，否则总共最多等待 1 秒
+func (q *OutboundQueue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+	if q.conf.WriteTimeout > 0 {
+		<-q.done
+		return
+	}
+	timer := time.NewTimer(defaultQueueFlushTimeout)
+	defer timer.Stop()
+	select {
+	case <-q.done:
+	case <-timer.C:
+	}
+}
+
+// Len 队列中等待写入的消息数量
+func (q *OutboundQueue) Len() int {
+	return len(q.ch)
+}
+
+func (q *OutboundQueue) run() {
+	defer close(q.done)
+	var err error
+	for err == nil {
+		select {
+		case resp := <-q.ch:
+			err = q.send(resp)
+		case <-q.closed:
+			// 写入剩余的消息
+			q.wait()
+			for err == nil {
+				select {
+				case resp := <-q.ch:
+					err = q.send(resp)
+				default:
+					return
+				}
+			}
+		}
+	}
+	// 写入失败后连接已经断开，剩余的消息不再写入
+	q.wait()
+	for {
+		select {
+		case resp := <-q.ch:
+			q.fail(resp, ErrQueueClosed)
+		default:
+			return
+		}
+	}
+}
+
+// 队列关闭后等待正在放入队列的 Push 返回，之后不会再有新的消息
+func (q *OutboundQueue) wait() {
+	q.mu.Lock()
+	q.mu.Unlock()
+}
+
+// 写入一个消息，写入失败时关闭队列并断开连接
+func (q *OutboundQueue) send(resp *Response) error {
+	var deadline time.Time
+	if q.conf.WriteTimeout > 0 {
+		deadline = time.Now().Add(q.conf.WriteTimeout)
+	}
+	if err := q.write(resp, deadline); err != nil {
+		q.fail(resp, err)
+		q.closeOnce.Do(func() {
+			close(q.closed)
+		})
+		if q.disconnect != nil {
+			go q.disconnect()
+		}
+		return err
+	}
+	if q.report != nil {
+		q.report(resp, nil)
+	}
+	return nil
+}
+
+// 发送队列丢弃消息的错误，这些错误会同时通过 report 通知
+func reportedByQueue(err error) bool {
+	return errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueDropped) || errors.Is(err, ErrSlowConsumer)
+}
+
+func (q *OutboundQueue) fail(resp *Response, err error) {
+	if q.report != nil {
+		q.report(resp, err)
+	}
+}
+
+// OnWriteError 设置推送消息失败时的回调，包括写入连接失败，以及发送队列满了之后被丢弃的消息
+// 错误可能是 ErrQueueFull, ErrQueueDropped, ErrSlowConsumer, ErrQueueClosed 或者连接的写入错误
+// 连接写入失败后队列中剩余的消息以 ErrQueueClosed 通知
+// 只能设置一个回调，可以添加多个回调的见 OnPushError
+// srv.OnWriteError(func(sid string, resp *cs.Response, err error) { log.Println(sid, resp.Cmd, err) })
+func (s *Srv) OnWriteError(f func(sid string, resp *Response, err error)) *Srv {
+	s.writeErrorHandler = f
+	return s
+}
+
+// WriteError 适配器推送消息失败时调用，通知 OnWriteError 和 OnPushError 设置的回调
+// err 为 nil 表示发送队列已经把消息写入连接，只统计监控指标，可以直接作为 NewOutboundQueue 的 report
+// 应该在实现 adapter 时才有用
+func (s *Srv) WriteError(sid string, resp *Response, err error) {
+	s.metrics.pushed(resp, err)
+	if err == nil {
+		return
+	}
+	s.logger.Log(LevelWarn, "write failed", "sid", sid, "cmd", resp.Cmd, "error", err)
+	s.pushFailed(sid, resp, err)
+}
@@ -0,0 +1,176 @@
+package cs_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+func TestOutboundQueue(t *testing.T) {
+	// 写入阻塞直到 release 关闭
+	newQueue := func(conf cs.QueueConfig) (*cs.OutboundQueue, chan struct{}, *[]string, *[]error, *sync.Mutex) {
+		release := make(chan struct{})
+		var written []string
+		var errs []error
+		mu := &sync.Mutex{}
+		q := cs.NewOutboundQueue(conf, func(resp *cs.Response, deadline time.Time) error {
+			<-release
+			mu.Lock()
+			written = append(written, resp.Cmd)
+			mu.Unlock()
+			return nil
+		}, func(resp *cs.Response, err error) {
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}, nil)
+		return q, release, &written, &errs, mu
+	}
+
+	gtest.C(t, func(t *gtest.T) {
+		q, release, written, errs, mu := newQueue(cs.QueueConfig{Size: 1, Policy: cs.QueueDropOldest})
+		t.Assert(q.Push(&cs.Response{Cmd: "a"}), nil) // 正在写入
+		time.Sleep(10 * time.Millisecond)
+		t.Assert(q.Push(&cs.Response{Cmd: "b"}), nil)
+		t.Assert(q.Push(&cs.Response{Cmd: "c"}), nil)
+		close(release)
+		q.Close()
+		mu.Lock()
+		t.Assert(*written, []string{"a", "c"})
+		t.Assert(*errs, []error{cs.ErrQueueDropped})
+		mu.Unlock()
+	})
+
+	gtest.C(t, func(t *gtest.T) {
+		q, release, written, _, mu := newQueue(cs.QueueConfig{Size: 1, Policy: cs.QueueDropNewest})
+		t.Assert(q.Push(&cs.Response{Cmd: "a"}), nil)
+		time.Sleep(10 * time.Millisecond)
+		t.Assert(q.Push(&cs.Response{Cmd: "b"}), nil)
+		t.Assert(q.Push(&cs.Response{Cmd: "c"}), cs.ErrQueueFull)
+		close(release)
+		q.Close()
+		mu.Lock()
+		t.Assert(*written, []string{"a", "b"})
+		mu.Unlock()
+		t.Assert(q.Push(&cs.Response{Cmd: "d"}), cs.ErrQueueClosed)
+	})
+
+	gtest.C(t, func(t *gtest.T) {
+		q, release, _, _, _ := newQueue(cs.QueueConfig{Size: 1, BlockTimeout: 10 * time.Millisecond})
+		q.Push(&cs.Response{Cmd: "a"})
+		time.Sleep(10 * time.Millisecond)
+		q.Push(&cs.Response{Cmd: "b"})
+		t.Assert(q.Push(&cs.Response{Cmd: "c"}), cs.ErrQueueFull)
+		close(release)
+		q.Close()
+	})
+
+	// 写入成功后以 nil 通知
+	gtest.C(t, func(t *gtest.T) {
+		reported := make(chan error, 1)
+		q := cs.NewOutboundQueue(cs.QueueConfig{}, func(resp *cs.Response, deadline time.Time) error {
+			return nil
+		}, func(resp *cs.Response, err error) {
+			reported <- err
+		}, nil)
+		q.Push(&cs.Response{Cmd: "a"})
+		select {
+		case err := <-reported:
+			t.Assert(err, nil)
+		case <-time.After(time.Second):
+			t.Error("successful write should be reported")
+		}
+		q.Close()
+	})
+
+	// 写入失败后队列中剩余的消息以 ErrQueueClosed 通知
+	gtest.C(t, func(t *gtest.T) {
+		release := make(chan struct{})
+		var mu sync.Mutex
+		reported := map[string]error{}
+		q := cs.NewOutboundQueue(cs.QueueConfig{Size: 2}, func(resp *cs.Response, deadline time.Time) error {
+			<-release
+			return errors.New("write failed")
+		}, func(resp *cs.Response, err error) {
+			mu.Lock()
+			reported[resp.Cmd] = err
+			mu.Unlock()
+		}, nil)
+		t.Assert(q.Push(&cs.Response{Cmd: "a"}), nil)
+		time.Sleep(10 * time.Millisecond)
+		t.Assert(q.Push(&cs.Response{Cmd: "b"}), nil)
+		t.Assert(q.Push(&cs.Response{Cmd: "c"}), nil)
+		close(release)
+		q.Close()
+		t.Assert(q.Len(), 0)
+		mu.Lock()
+		t.Assert(reported["a"].Error(), "write failed")
+		t.Assert(reported["b"], cs.ErrQueueClosed)
+		t.Assert(reported["c"], cs.ErrQueueClosed)
+		mu.Unlock()
+		t.Assert(q.Push(&cs.Response{Cmd: "d"}), cs.ErrQueueClosed)
+	})
+
+	// 和 Close 并发的 Push 返回 nil 的消息都会写入或者通知
+	gtest.C(t, func(t *gtest.T) {
+		var accepted, reported int32
+		q := cs.NewOutboundQueue(cs.QueueConfig{Size: 1000, WriteTimeout: time.Second}, func(resp *cs.Response, deadline time.Time) error {
+			return nil
+		}, func(resp *cs.Response, err error) {
+			atomic.AddInt32(&reported, 1)
+		}, nil)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if q.Push(&cs.Response{Cmd: "a"}) == nil {
+						atomic.AddInt32(&accepted, 1)
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		q.Close()
+		wg.Wait()
+		t.Assert(atomic.LoadInt32(&reported), atomic.LoadInt32(&accepted))
+	})
+
+	gtest.C(t, func(t *gtest.T) {
+		disconnected := make(chan struct{})
+		q := cs.NewOutboundQueue(cs.QueueConfig{Size: 1, Policy: cs.QueueDisconnect}, func(resp *cs.Response, deadline time.Time) error {
+			return errors.New("write failed")
+		}, nil, func() {
+			close(disconnected)
+		})
+		q.Push(&cs.Response{Cmd: "a"})
+		select {
+		case <-disconnected:
+		case <-time.After(time.Second):
+			t.Error("write error should disconnect")
+		}
+		q.Close()
+	})
+}
+
+func TestSrv_OnWriteError(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		srv := cs.New()
+		var got error
+		srv.OnWriteError(func(sid string, resp *cs.Response, err error) {
+			t.Assert(sid, "1")
+			got = err
+		})
+		srv.WriteError("1", &cs.Response{}, cs.ErrSlowConsumer)
+		t.Assert(got, cs.ErrSlowConsumer)
+	})
+}
@@ -0,0 +1,197 @@
+package cs
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimitKey 限流的维度
+type RateLimitKey int
+
+const (
+	// RateLimitBySID 按会话限流
+	RateLimitBySID RateLimitKey = iota
+	// RateLimitByUser 按会话绑定的用户限流，同一个用户的所有会话共享限额，没有绑定用户的会话按会话限流
+	RateLimitByUser
+	// RateLimitByIP 按会话的远程 IP 限流，适配器需要实现 RemoteAddrAdapter，否则按会话限流
+	RateLimitByIP
+)
+
+// RateLimitRule 命令的限流规则
+type RateLimitRule struct {
+	Cmd   string  // 命令，支持和路由一样的模式，如 chat.*
+	Rate  float64 // 每秒允许的请求数量，小于等于 0 时不限制
+	Burst int     // 允许的突发请求数量，默认为 Rate 向上取整
+}
+
+// RateLimitConfig 限流中间件的配置，使用令牌桶算法
+type RateLimitConfig struct {
+	Key   RateLimitKey    // 限流的维度，默认按会话
+	Rate  float64         // 没有匹配到 Rules 的命令，每秒允许的请求数量，小于等于 0 时不限制
+	Burst int             // 没有匹配到 Rules 的命令，允许的突发请求数量，默认为 Rate 向上取整
+	Rules []RateLimitRule // 命令的限流规则，每个规则单独计算限额，按路由的优先级匹配
+	Code  int             // 超出限额时的响应码，默认为 CodeRateLimit
+	Msg   string          // 超出限额时的响应消息，默认为 "too many requests"
+	// MaxViolations 会话累计超出限额的次数达到该值时关闭会话，默认为 0 不关闭
+	MaxViolations int
+}
+
+// RateLimit 限流中间件，超出限额的请求不会执行后续的处理函数，直接响应 Code
+// 令牌桶保存在中间件的内存中，会话关闭后自动清理，内置命令不受限制
+// 每个会话每秒 10 个请求，允许突发 20 个，new_message 命令单独限制为每秒 1 个
+// srv.Use(cs.RateLimit(cs.RateLimitConfig{Rate: 10, Burst: 20, Rules: []cs.RateLimitRule{{Cmd: "new_message", Rate: 1}}}))
+func RateLimit(conf RateLimitConfig) HandlerFunc {
+	if conf.Code == 0 {
+		conf.Code = CodeRateLimit
+	}
+	if conf.Msg == "" {
+		conf.Msg = msgRateLimit
+	}
+	rules := newRouter()
+	for i := range conf.Rules {
+		rules.add(conf.Rules[i].Cmd, &registration{})
+	}
+	l := &rateLimiter{
+		conf:       conf,
+		rules:      rules,
+		buckets:    map[string]map[string]*tokenBucket{},
+		keySIDs:    map[string]map[string]struct{}{},
+		sidKeys:    map[string]string{},
+		violations: map[string]int{},
+	}
+	var hookOnce sync.Once
+
+	return func(c *Context) {
+		hookOnce.Do(func() {
+			c.Srv.onClose(l.removeSid)
+		})
+		if isInternalCmd(c.Cmd) || l.allow(c) {
+			c.Next()
+			return
+		}
+		c.Resp(conf.Code, conf.Msg, struct{}{})
+		c.Abort()
+		if l.violate(c.SID) {
+			// 先推送拒绝的响应再关闭会话，之后不再重复推送
+			c.Srv.PushServer(c.Server, c.SID, c.Response)
+			c.responded = true
+			c.Close()
+		}
+	}
+}
+
+type rateLimiter struct {
+	conf       RateLimitConfig
+	rules      *router
+	mu         sync.Mutex
+	buckets    map[string]map[string]*tokenBucket // 限流维度的值 => 命中的规则 => 令牌桶
+	keySIDs    map[string]map[string]struct{}     // 限流维度的值正在被哪些会话使用，没有会话使用时清理令牌桶
+	sidKeys    map[string]string
+	violations map[string]int // 会话超出限额的次数
+}
+
+// 令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 请求是否在限额内
+func (l *rateLimiter) allow(c *Context) bool {
+	rate, burst := l.conf.Rate, l.conf.Burst
+	ruleCmd := ""
+	if rt, _ := l.rules.match(c.Cmd); rt != nil {
+		for _, rule := range l.conf.Rules {
+			if rule.Cmd == rt.cmd {
+				rate, burst = rule.Rate, rule.Burst
+				ruleCmd = rule.Cmd
+				break
+			}
+		}
+	}
+	if rate <= 0 {
+		return true
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+
+	key := l.key(c)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if old, ok := l.sidKeys[c.SID]; !ok || old != key {
+		l.unbind(c.SID)
+		l.sidKeys[c.SID] = key
+		indexAdd(l.keySIDs, key, c.SID)
+	}
+	buckets, ok := l.buckets[key]
+	if !ok {
+		buckets = map[string]*tokenBucket{}
+		l.buckets[key] = buckets
+	}
+	b, ok := buckets[ruleCmd]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		buckets[ruleCmd] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 限流维度的值
+func (l *rateLimiter) key(c *Context) string {
+	switch l.conf.Key {
+	case RateLimitByUser:
+		if uid := c.UserID(); uid != "" {
+			return "user:" + uid
+		}
+	case RateLimitByIP:
+		if addr := c.RemoteAddr(); addr != "" {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+			return "ip:" + addr
+		}
+	}
+	return "sid:" + c.SID
+}
+
+// 记录一次超出限额，返回是否需要关闭会话
+func (l *rateLimiter) violate(sid string) bool {
+	if l.conf.MaxViolations <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.violations[sid]++
+	return l.violations[sid] >= l.conf.MaxViolations
+}
+
+// 会话关闭时清理数据
+func (l *rateLimiter) removeSid(sid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.unbind(sid)
+	delete(l.violations, sid)
+}
+
+// 解除会话和限流维度的值的关联，没有会话使用时删除令牌桶，调用方需持有锁
+func (l *rateLimiter) unbind(sid string) {
+	key, ok := l.sidKeys[sid]
+	if !ok {
+		return
+	}
+	delete(l.sidKeys, sid)
+	indexRemove(l.keySIDs, key, sid)
+	if _, used := l.keySIDs[key]; !used {
+		delete(l.buckets, key)
+	}
+}
@@ -0,0 +1,54 @@
+package cs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+func TestRateLimit(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetDispatch(cs.DispatchConfig{Mode: cs.DispatchSerialSID})
+		srv.Use(cs.RateLimit(cs.RateLimitConfig{
+			Rules:         []cs.RateLimitRule{{Cmd: "chat.*", Rate: 1, Burst: 2}},
+			MaxViolations: 2,
+		}))
+		srv.Handle("chat.send", func(c *cs.Context) {})
+		srv.Handle("ping", func(c *cs.Context) {})
+		pushErrs := make(chan error, 1)
+		srv.OnPushError(func(sid string, resp *cs.Response, err error) {
+			pushErrs <- err
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		codes := []int{}
+		for i := 0; i < 3; i++ {
+			server.receive <- &cs.Request{Cmd: "chat.send"}
+			codes = append(codes, (<-server.written).Code)
+		}
+		t.Assert(codes, []int{0, 0, cs.CodeRateLimit})
+
+		// 没有匹配到规则的命令不限制
+		for i := 0; i < 3; i++ {
+			server.receive <- &cs.Request{Cmd: "ping"}
+			t.Assert((<-server.written).Code, 0)
+		}
+
+		// 第二次超出限额时关闭会话
+		server.receive <- &cs.Request{Cmd: "chat.send"}
+		t.Assert((<-server.written).Code, cs.CodeRateLimit)
+		time.Sleep(10 * time.Millisecond)
+		t.Assert(server.GetAllSID(), []string{})
+		// 拒绝的响应只推送一次
+		t.Assert(len(server.written), 0)
+		t.Assert(len(pushErrs), 0)
+	})
+}
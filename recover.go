@@ -1,19 +1,21 @@
 package cs
 
-import (
-	"runtime/debug"
-)
-
 // Recover 错误处理中间件
-// 当处理函数发生 panic 时在该中间件恢复，并根据panic 的内容默认处理响应数据
+// 当处理函数发生 panic 时在该中间件恢复，并根据panic 的内容默认处理响应数据，panic 和调用栈通过 Srv 的日志输出
+// panic 的错误链中有 *cs.Error 时使用它的响应码、消息和数据，c.Exit 只结束请求，不会被当作 panic 处理
 func Recover() HandlerFunc {
 	return func(c *Context) {
 		defer func() {
 			if data := recover(); data != nil {
-				debug.PrintStack()
-				c.Response.Code = -2
+				if _, ok := data.(internalPanic); ok {
+					// c.Exit 结束请求，保留已经设置的响应
+					c.Abort()
+					return
+				}
+				c.Srv.panicked(c, data)
+				c.Response.Code = CodePanic
 				if err, ok := data.(error); ok {
-					c.Response.Msg = err.Error()
+					c.setError(err, CodePanic)
 				} else if s, ok := data.(string); ok {
 					c.Response.Msg = s
 				} else if r, ok := data.(*Response); ok {
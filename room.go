@@ -0,0 +1,94 @@
+package cs
+
+// Join 会话 sid 加入房间，可同时加入多个房间，会话关闭后自动退出所有房间
+func (s *Srv) Join(sid string, rooms ...string) {
+	for _, room := range rooms {
+		s.rooms.add(room, sid)
+	}
+}
+
+// Leave 会话 sid 退出房间，不指定房间时退出所有房间
+func (s *Srv) Leave(sid string, rooms ...string) {
+	if len(rooms) == 0 {
+		s.rooms.removeSid(sid)
+		return
+	}
+	for _, room := range rooms {
+		s.rooms.remove(room, sid)
+	}
+}
+
+// Rooms 会话 sid 加入的所有房间
+func (s *Srv) Rooms(sid string) []string {
+	return s.rooms.keysOf(sid)
+}
+
+// RoomMembers 房间中所有会话的 SID
+func (s *Srv) RoomMembers(room string) []string {
+	return s.rooms.sidsOf(room)
+}
+
+// BroadcastRoom 往房间中的所有会话推送消息，except 中的会话除外
+// 消息会经过推送中间件，会阻塞直到所有的会话都推送完成
+func (s *Srv) BroadcastRoom(room string, resp *Response, except ...string) *BroadcastResult {
+	return s.broadcastRoom(nil, room, resp, except)
+}
+
+// 往房间推送消息，c 为空时以接收者的会话执行推送中间件
+func (s *Srv) broadcastRoom(c *Context, room string, resp *Response, except []string) *BroadcastResult {
+	targets := []broadcastTarget{}
+	failed := map[string]error{}
+	for _, sid := range s.RoomMembers(room) {
+		if containsString(except, sid) {
+			continue
+		}
+		server, err := s.getSidServer(sid)
+		if err != nil {
+			failed[sid] = err
+			continue
+		}
+		targets = append(targets, broadcastTarget{server, sid})
+	}
+	result := s.fanout(c, targets, resp)
+	for sid, err := range failed {
+		result.Failed[sid] = err
+	}
+	return result
+}
+
+// 在请求上下文之外推送消息时，用于执行推送中间件的上下文
+func (s *Srv) pushContext(server ServerAdapter, sid string) *Context {
+	return &Context{
+		Response:     &Response{Request: &Request{}},
+		SID:          sid,
+		Srv:          s,
+		Server:       server,
+		handlerIndex: -1,
+	}
+}
+
+// Join 当前会话加入房间
+func (c *Context) Join(rooms ...string) {
+	c.Srv.Join(c.SID, rooms...)
+}
+
+// Leave 当前会话退出房间，不指定房间时退出所有房间
+func (c *Context) Leave(rooms ...string) {
+	c.Srv.Leave(c.SID, rooms...)
+}
+
+// Rooms 当前会话加入的所有房间
+func (c *Context) Rooms() []string {
+	return c.Srv.Rooms(c.SID)
+}
+
+// RoomMembers 房间中所有会话的 SID
+func (c *Context) RoomMembers(room string) []string {
+	return c.Srv.RoomMembers(room)
+}
+
+// BroadcastRoom 往房间中的所有会话推送消息，except 中的会话除外
+// 如需排除当前会话：c.BroadcastRoom(room, resp, c.SID)
+func (c *Context) BroadcastRoom(room string, resp *Response, except ...string) *BroadcastResult {
+	return c.Srv.broadcastRoom(c, room, resp, except)
+}
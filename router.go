@@ -0,0 +1,199 @@
+package cs
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 路由命令的分段分隔符
+const routeSep = "."
+
+// 内置命令的前缀，内置命令只会精确匹配
+const internalCmdPrefix = "__cs_"
+
+// 路由分段的类型，值越小匹配优先级越高
+const (
+	segmentStatic   = iota // 普通字符
+	segmentParam           // 参数，如 :id
+	segmentWildcard        // 通配符 *
+)
+
+// 路由表，支持精确匹配和模式匹配
+// 模式路由以 . 分段，:name 匹配任意一个分段并作为参数，* 只能作为最后一个分段，匹配剩余的一个或多个分段
+// order.*        匹配 order.create, order.item.add
+// room.:id.join  匹配 room.100.join，c.Param("id") == "100"
+// 匹配优先级：精确匹配 > 模式匹配，模式之间按分段从左到右比较，普通字符 > 参数 > 通配符，再按分段数多的优先，最后按注册顺序
+type router struct {
+	mu       sync.RWMutex
+	exact    map[string]*route
+	patterns []*route
+	count    int
+}
+
+// 路由
+type route struct {
+	cmd      string
+	segments []string
+	kinds    []int
+	handlers []HandlerFunc   // 路由执行的所有处理函数，包括分组中间件
+	regs     []*registration // 每次注册的记录
+	order    int
+}
+
+// 一次路由注册
+type registration struct {
+	middleware []HandlerFunc // 分组中间件
+	handlers   []HandlerFunc // 路由处理函数
+	file       string        // 注册路由的源码文件
+	line       int           // 注册路由的源码行号
+	typed      *typedInfo    // 使用 HandleTyped 注册的类型信息
+}
+
+func newRouter() *router {
+	return &router{exact: map[string]*route{}}
+}
+
+// 注册路由，同一个命令多次注册时处理函数会追加
+func (r *router) add(cmd string, reg *registration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rt := r.find(cmd); rt != nil {
+		rt.regs = append(rt.regs, reg)
+		rt.handlers = append(rt.handlers, reg.middleware...)
+		rt.handlers = append(rt.handlers, reg.handlers...)
+		return
+	}
+	handlers := make([]HandlerFunc, 0, len(reg.middleware)+len(reg.handlers))
+	handlers = append(handlers, reg.middleware...)
+	handlers = append(handlers, reg.handlers...)
+	rt := &route{cmd: cmd, handlers: handlers, regs: []*registration{reg}, order: r.count}
+	r.count++
+	if !isPattern(cmd) {
+		r.exact[cmd] = rt
+		return
+	}
+	rt.segments = strings.Split(cmd, routeSep)
+	rt.kinds = make([]int, len(rt.segments))
+	for i, seg := range rt.segments {
+		rt.kinds[i] = segmentKind(seg)
+		if rt.kinds[i] == segmentWildcard && i != len(rt.segments)-1 {
+			panic("cs: wildcard * must be the last segment of route " + cmd)
+		}
+	}
+	r.patterns = append(r.patterns, rt)
+	sort.SliceStable(r.patterns, func(i, j int) bool {
+		return r.patterns[i].before(r.patterns[j])
+	})
+}
+
+// 查找已注册的路由，调用方需持有锁
+func (r *router) find(cmd string) *route {
+	if rt, ok := r.exact[cmd]; ok {
+		return rt
+	}
+	for _, rt := range r.patterns {
+		if rt.cmd == cmd {
+			return rt
+		}
+	}
+	return nil
+}
+
+// 匹配命令对应的路由，返回路由和路由参数，没有匹配到时返回 nil
+func (r *router) match(cmd string) (*route, map[string]string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if rt, ok := r.exact[cmd]; ok {
+		return rt, nil
+	}
+	if len(r.patterns) == 0 || isInternalCmd(cmd) {
+		return nil, nil
+	}
+	segments := strings.Split(cmd, routeSep)
+	for _, rt := range r.patterns {
+		if params, ok := rt.match(segments); ok {
+			return rt, params
+		}
+	}
+	return nil, nil
+}
+
+// 所有的路由，精确匹配的在前，模式路由按优先级排序
+func (r *router) all() []*route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	routes := make([]*route, 0, len(r.exact)+len(r.patterns))
+	for _, rt := range r.exact {
+		routes = append(routes, rt)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].order < routes[j].order
+	})
+	return append(routes, r.patterns...)
+}
+
+// 模式路由匹配命令分段
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	var params map[string]string
+	for i, seg := range rt.segments {
+		switch rt.kinds[i] {
+		case segmentWildcard:
+			return params, len(segments) > i
+		case segmentParam:
+			if i >= len(segments) || segments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[seg[1:]] = segments[i]
+		default:
+			if i >= len(segments) || segments[i] != seg {
+				return nil, false
+			}
+		}
+	}
+	return params, len(segments) == len(rt.segments)
+}
+
+// 模式路由的匹配优先级是否比 o 高
+func (rt *route) before(o *route) bool {
+	for i := 0; i < len(rt.kinds) && i < len(o.kinds); i++ {
+		if rt.kinds[i] != o.kinds[i] {
+			return rt.kinds[i] < o.kinds[i]
+		}
+	}
+	if len(rt.kinds) != len(o.kinds) {
+		return len(rt.kinds) > len(o.kinds)
+	}
+	return rt.order < o.order
+}
+
+// 命令是否是模式路由
+func isPattern(cmd string) bool {
+	if isInternalCmd(cmd) {
+		return false
+	}
+	for _, seg := range strings.Split(cmd, routeSep) {
+		if segmentKind(seg) != segmentStatic {
+			return true
+		}
+	}
+	return false
+}
+
+func segmentKind(seg string) int {
+	if seg == "*" {
+		return segmentWildcard
+	}
+	if len(seg) > 1 && seg[0] == ':' {
+		return segmentParam
+	}
+	return segmentStatic
+}
+
+// 是否是内置命令
+func isInternalCmd(cmd string) bool {
+	return strings.HasPrefix(cmd, internalCmdPrefix)
+}
@@ -0,0 +1,68 @@
+package cs
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// RouteInfo 路由信息，用于查看已注册的路由
+type RouteInfo struct {
+	Cmd        string       // 注册的命令，可能是模式路由如 order.*
+	Handler    string       // 最后一个处理函数的名称
+	Handlers   []string     // 路由的处理函数名称
+	Middleware []string     // 路由会执行的中间件名称，包括全局中间件和分组中间件，按执行顺序
+	File       string       // 注册路由的源码文件
+	Line       int          // 注册路由的源码行号
+	Request    reflect.Type // 使用 HandleTyped 注册的路由的请求类型，否则为 nil
+	Response   reflect.Type // 使用 HandleTyped 注册的路由的响应类型，否则为 nil
+}
+
+// Routes 获取所有已注册的路由，精确匹配的路由按注册顺序在前，模式路由按匹配优先级在后
+// 同一个命令多次注册时合并为一条，源码位置为第一次注册的位置
+func (s *Srv) Routes() []RouteInfo {
+	routes := s.router.all()
+	infos := make([]RouteInfo, 0, len(routes))
+	for _, rt := range routes {
+		info := RouteInfo{
+			Cmd:        rt.cmd,
+			Handlers:   []string{},
+			Middleware: funcNames(s.middleware),
+		}
+		for _, reg := range rt.regs {
+			info.Middleware = append(info.Middleware, funcNames(reg.middleware)...)
+			info.Handlers = append(info.Handlers, funcNames(reg.handlers)...)
+			if reg.typed != nil {
+				info.Request = reg.typed.request
+				info.Response = reg.typed.response
+			}
+		}
+		if len(info.Handlers) > 0 {
+			info.Handler = info.Handlers[len(info.Handlers)-1]
+		}
+		if len(rt.regs) > 0 {
+			info.File = rt.regs[0].file
+			info.Line = rt.regs[0].line
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// 打印路由表到调试输出
+func (s *Srv) printRoutes() {
+	if s.debugOutput == nil {
+		return
+	}
+	for _, info := range s.Routes() {
+		fmt.Fprintf(s.debugOutput, "[SRV-debug] %s => %s[%d handlers]\n",
+			info.Cmd, info.Handler, len(info.Handlers)+len(info.Middleware))
+	}
+}
+
+func funcNames(handlers []HandlerFunc) []string {
+	names := make([]string, 0, len(handlers))
+	for _, h := range handlers {
+		names = append(names, funcName(h))
+	}
+	return names
+}
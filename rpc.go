@@ -0,0 +1,113 @@
+package cs
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrSessionClosed 等待客户端回复时会话已关闭
+var ErrSessionClosed = errors.New("cs: session closed")
+
+// 等待客户端回复的请求
+type pendingRequest struct {
+	sid   string
+	reply chan *Request // 客户端的回复
+	done  chan struct{} // 会话关闭时关闭
+}
+
+// 等待回复的请求，seqno => *pendingRequest
+type pendingRequests struct {
+	mu   sync.Mutex
+	reqs map[string]*pendingRequest
+}
+
+// Request 服务端主动往会话 sid 发送请求，并等待客户端回复
+// 请求以推送消息的方式发送，消息的 seqno 由服务端生成，客户端回复任意 cmd 并带上相同的 seqno 即为该请求的回复
+// 回复消息不会经过路由和中间件，而是直接作为返回值，超时由 ctx 控制，超时后返回 ctx.Err()
+// 会话关闭时返回 ErrSessionClosed，服务关闭时返回 ErrServerClosed
+// 在处理函数中调用时 ctx 应该传递 c.Context()，等待回复期间该消息不占用 DispatchConfig.MaxInFlight 的限制
+// reply, err := srv.Request(c.Context(), sid, "confirm_payment", order)
+func (s *Srv) Request(ctx context.Context, sid, cmd string, data interface{}) (*Request, error) {
+	server, err := s.getSidServer(sid)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := s.callPushMiddleware(s.pushContext(server, sid), &Response{Cmd: cmd, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	resp := pc.Response
+	resp.Seqno = randomString(16)
+
+	p := &pendingRequest{
+		sid:   sid,
+		reply: make(chan *Request, 1),
+		done:  make(chan struct{}),
+	}
+	s.pending.add(resp.Seqno, p)
+	defer s.pending.remove(resp.Seqno)
+
+	if err := s.PushServer(server, sid, resp); err != nil {
+		return nil, err
+	}
+
+	if slot, ok := ctx.Value(flightSlotKey{}).(*flightSlot); ok {
+		slot.yield()
+		defer slot.resume()
+	}
+	select {
+	case req := <-p.reply:
+		return req, nil
+	case <-p.done:
+		return nil, ErrSessionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, ErrServerClosed
+	}
+}
+
+func (p *pendingRequests) add(seqno string, req *pendingRequest) {
+	p.mu.Lock()
+	if p.reqs == nil {
+		p.reqs = map[string]*pendingRequest{}
+	}
+	p.reqs[seqno] = req
+	p.mu.Unlock()
+}
+
+func (p *pendingRequests) remove(seqno string) {
+	p.mu.Lock()
+	delete(p.reqs, seqno)
+	p.mu.Unlock()
+}
+
+// 如果消息是等待中的请求的回复，则投递给该请求，返回是否已投递
+// 只接受发送请求的会话的回复
+func (p *pendingRequests) resolve(sid string, req *Request) bool {
+	if req.Seqno == "" || isInternalCmd(req.Cmd) {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr, ok := p.reqs[req.Seqno]
+	if !ok || pr.sid != sid {
+		return false
+	}
+	delete(p.reqs, req.Seqno)
+	pr.reply <- req
+	return true
+}
+
+// 会话关闭时，结束该会话所有等待中的请求
+func (p *pendingRequests) closeSid(sid string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for seqno, pr := range p.reqs {
+		if pr.sid == sid {
+			delete(p.reqs, seqno)
+			close(pr.done)
+		}
+	}
+}
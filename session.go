@@ -0,0 +1,59 @@
+package cs
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// 会话注册表中的会话，在适配器产生 CmdConnected 时注册，CmdClosed 时移除
+type session struct {
+	sid    string
+	server ServerAdapter
+}
+
+// SessionCount 当前在线的会话数量
+// 只统计适配器通过 CmdConnected 通知过的会话
+func (s *Srv) SessionCount() int {
+	return int(atomic.LoadInt64(&s.sessionCount))
+}
+
+// RangeSession 遍历所有在线的会话，f 返回 false 时停止遍历
+// 不会复制所有的 SID，适合会话数量很多的场景，只包含适配器通过 CmdConnected 通知过的会话
+func (s *Srv) RangeSession(f func(sid string, server ServerAdapter) bool) {
+	s.sessions.Range(func(key, val interface{}) bool {
+		sess := val.(*session)
+		return f(sess.sid, sess.server)
+	})
+}
+
+// 注册会话
+func (s *Srv) addSession(server ServerAdapter, sid string) {
+	if _, loaded := s.sessions.LoadOrStore(sid, &session{sid: sid, server: server}); !loaded {
+		atomic.AddInt64(&s.sessionCount, 1)
+		s.metrics.connected(server)
+	}
+}
+
+// 移除会话
+func (s *Srv) removeSession(sid string) {
+	if val, loaded := s.sessions.LoadAndDelete(sid); loaded {
+		atomic.AddInt64(&s.sessionCount, -1)
+		s.metrics.closed(val.(*session).server)
+	}
+}
+
+// 获取会话所属的适配器
+// 优先从会话注册表中查找，没有 CmdConnected 通知的适配器会遍历查找
+func (s *Srv) getSidServer(sid string) (ServerAdapter, error) {
+	if val, ok := s.sessions.Load(sid); ok {
+		return val.(*session).server, nil
+	}
+	for _, server := range s.Server {
+		for _, id := range server.GetAllSID() {
+			if id == sid {
+				return server, nil
+			}
+		}
+	}
+	return nil, errors.New("the sid is destroy")
+}
@@ -0,0 +1,95 @@
+package cs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed 调用 Shutdown 后，Run 返回该错误
+var ErrServerClosed = errors.New("cs: Server closed")
+
+// 等待处理函数执行完成时的轮询间隔
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown 优雅关闭服务，会阻塞直到关闭完成或者 ctx 超时
+// 关闭流程：
+// 1. 停止接收所有适配器的新消息
+// 2. 等待正在执行的处理函数执行完成
+// 3. 关闭所有会话，会话的 CmdClosed 处理函数会被执行
+// 4. 调用适配器的 ShutdownAdapter 接口，等待适配器的消息读取完毕
+// 5. Run 返回 ErrServerClosed
+// 如果 ctx 在等待过程中超时，会取消所有请求的 c.Context()，不再等待剩余的处理函数，继续完成关闭流程并返回 ctx.Err()
+func (s *Srv) Shutdown(ctx context.Context) error {
+	s.serverMu.Lock()
+	if !atomic.CompareAndSwapInt32(&s.inShutdown, 0, 1) {
+		s.serverMu.Unlock()
+		return ErrServerClosed
+	}
+	servers := make([]ServerAdapter, len(s.Server))
+	copy(servers, s.Server)
+	serving := make([]*serving, len(s.serving))
+	copy(serving, s.serving)
+	s.serverMu.Unlock()
+
+	err := s.waitIdle(ctx)
+	if err != nil {
+		// 等待超时，通知还未执行完成的处理函数取消
+		s.baseCancel()
+	}
+
+	// 关闭所有会话，适配器会产生 CmdClosed 消息
+	for _, server := range servers {
+		for _, sid := range server.GetAllSID() {
+			s.closeWithReason(server, sid, CloseReasonShutdown)
+		}
+	}
+
+	for _, server := range servers {
+		if h, ok := server.(ShutdownAdapter); ok {
+			if e := h.Shutdown(ctx); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+
+	// 实现了 ShutdownAdapter 的适配器，会在读完剩余消息后退出读取循环
+	for _, sv := range serving {
+		if _, ok := sv.server.(ShutdownAdapter); !ok {
+			continue
+		}
+		select {
+		case <-sv.done:
+		case <-ctx.Done():
+		}
+	}
+
+	if e := s.waitIdle(ctx); e != nil && err == nil {
+		err = e
+	}
+	s.baseCancel()
+	close(s.done)
+	s.dispatcher.stop()
+	return err
+}
+
+// 等待所有正在执行的处理函数执行完成
+func (s *Srv) waitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if atomic.LoadInt64(&s.inFlight) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Srv) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
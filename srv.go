@@ -1,9 +1,12 @@
 package cs
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"io"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gogf/gf/os/gcache"
@@ -13,23 +16,74 @@ import (
 type Srv struct {
 	Server             []ServerAdapter // 服务器适配器
 	serverMu           sync.Mutex
-	isRunning          bool                     // 服务是否已经正在运行
-	runErr             chan error               // 服务运行错误通知
-	middleware         []HandlerFunc            // 全局路由中间件
-	pushMiddleware     []PushHandlerFunc        // 全局推送中间件
-	internalMiddleware []HandlerFunc            // 内部的中间件，执行顺序在洋葱模型的最里层
-	routes             map[string][]HandlerFunc // 路由的处理函数
-	state              *State                   // SID 会话的状态数据
+	isRunning          bool              // 服务是否已经正在运行
+	runErr             chan error        // 服务运行错误通知
+	middleware         []HandlerFunc     // 全局路由中间件
+	pushMiddleware     []PushHandlerFunc // 全局推送中间件
+	internalMiddleware []HandlerFunc     // 内部的中间件，执行顺序在洋葱模型的最里层
+	router             *router           // 路由的处理函数
+	state              *State            // SID 会话的状态数据
+	inShutdown         int32             // 是否正在关闭服务，原子操作
+	inFlight           int64             // 正在执行的处理函数数量，原子操作
+	serving            []*serving        // 正在读取消息的适配器
+	done               chan struct{}     // 服务已关闭的通知
+	baseCtx            context.Context   // 所有请求上下文的根，服务关闭时取消
+	baseCancel         context.CancelFunc
+	requestTimeout     time.Duration                    // 每个请求上下文的超时时长，0 为不限制
+	activeCtx          map[string]map[*Context]struct{} // 各会话正在执行的请求上下文
+	activeCtxMu        sync.Mutex
+	debugOutput        io.Writer       // 调试信息的输出，如启动时打印的路由表
+	sessions           sync.Map        // 会话注册表，sid => *session
+	sessionCount       int64           // 会话数量，原子操作
+	rooms              *sidIndex       // 房间和会话的索引
+	users              *sidIndex       // 用户和会话的索引
+	pending            pendingRequests // 服务端主动发送的，等待客户端回复的请求
+	dispatcher         *dispatcher     // 消息调度器
+	writeErrorHandler  func(sid string, resp *Response, err error)
+	broadcastLimit     int                // 广播时同时推送的会话数量
+	closeHooks         []func(sid string) // 会话关闭时的内部回调，如清理中间件的数据
+	closeHooksMu       sync.RWMutex
+	authHandler        func(a *Auth) error                             // 会话的认证函数
+	authStates         sync.Map                                        // 会话的认证状态，sid => *authState
+	metrics            *Metrics                                        // 监控指标
+	tracer             Tracer                                          // 跟踪器
+	logger             Logger                                          // 日志
+	validation         *validation                                     // Context.Parse 的验证配置
+	connectHooks       []func(sid string, server ServerAdapter)        // OnConnect 的回调
+	closeUserHooks     []func(sid string, reason CloseReason)          // OnClose 的回调
+	closeReasons       sync.Map                                        // 服务端关闭的会话的原因，sid => CloseReason
+	adapterErrorHooks  []func(server ServerAdapter, err error)         // OnAdapterError 的回调
+	pushErrorHooks     []func(sid string, resp *Response, err error)   // OnPushError 的回调
+	panicHooks         []func(c *Context, v interface{}, stack []byte) // OnPanic 的回调
+	errorMapper        func(err error) *Error                          // 内部错误到对外错误的映射
+}
+
+// 正在被读取消息的适配器
+type serving struct {
+	server ServerAdapter
+	done   chan struct{} // 读取消息的循环退出时关闭
 }
 
 // New 指定服务器实例化一个消息服务
 func New(server ...ServerAdapter) *Srv {
 	srv := &Srv{
-		Server: server,
-		runErr: make(chan error, 0),
-		routes: map[string][]HandlerFunc{},
-		state:  &State{cache: gcache.New()},
+		Server:         server,
+		runErr:         make(chan error, 0),
+		router:         newRouter(),
+		state:          &State{cache: gcache.New()},
+		done:           make(chan struct{}),
+		rooms:          newSidIndex(),
+		broadcastLimit: defaultBroadcastLimit,
+		users:          newSidIndex(),
+
+		activeCtx:   map[string]map[*Context]struct{}{},
+		debugOutput: os.Stdout,
+		logger:      defaultLogger,
 	}
+	srv.baseCtx, srv.baseCancel = context.WithCancel(context.Background())
+	srv.metrics = newMetrics(srv)
+	srv.tracer = noopTracer{}
+	srv.SetDispatch(DispatchConfig{})
 	// 推送前填充数据
 	srv.UsePush(fillPushResp)
 
@@ -44,9 +98,9 @@ func (s *Srv) AddServer(server ...ServerAdapter) *Srv {
 	s.Server = append(s.Server, server...)
 
 	// 如果服务已经正在 running 了，增加的时候自动启动
-	if s.isRunning {
+	if s.isRunning && !s.shuttingDown() {
 		for _, ser := range server {
-			go s.startServer(ser)
+			s.serve(ser)
 		}
 	}
 	s.serverMu.Unlock()
@@ -59,6 +113,13 @@ func (s *Srv) SetStateExpire(t time.Duration) *Srv {
 	return s
 }
 
+// SetRequestTimeout 设置每个请求上下文 context.Context 的超时时长，超时后 c.Context() 会被取消
+// 只是通知处理函数取消，并不会中断处理函数的执行，0 为不限制
+func (s *Srv) SetRequestTimeout(t time.Duration) *Srv {
+	s.requestTimeout = t
+	return s
+}
+
 // SetStateAdapter 设置状态管理的存储适配器，默认是存储在内存中，可设置为其他
 func (s *Srv) SetStateAdapter(adapter gcache.Adapter) *Srv {
 	s.state.SetAdapter(adapter)
@@ -92,23 +153,43 @@ func (s *Srv) Group(handlers ...HandlerFunc) *SrvGroup {
 	return srv
 }
 
-var routeMu sync.Mutex
-
 // Handle 注册路由，cmd 是命令， handlers 是该路由的处理函数
+// cmd 支持以 . 分段的模式路由，:name 匹配一个分段并可以使用 c.Param("name") 获取，* 作为最后一个分段匹配剩余的所有分段
+// srv.Handle("order.create", h) 精确匹配
+// srv.Handle("room.:id.join", h) 匹配 room.1.join, room.2.join
+// srv.Handle("order.*", h) 匹配 order.cancel, order.item.add
+// 精确匹配的路由优先于模式路由
 func (s *Srv) Handle(cmd string, handlers ...HandlerFunc) *Srv {
-	srv := s
+	s.handle(cmd, nil, handlers, nil, 2)
+	return s
+}
+
+// HandleTyped 注册使用 NewTypedRoute 创建的路由，并记录请求和响应的类型，可以通过 Srv.Routes 查看
+// middleware 是只在该路由执行的中间件，在处理函数之前执行
+func (s *Srv) HandleTyped(cmd string, route TypedRoute, middleware ...HandlerFunc) *Srv {
+	s.handle(cmd, nil, append(append([]HandlerFunc{}, middleware...), route.handler), route.typed, 2)
+	return s
+}
+
+// 注册路由，middleware 是分组中间件，typed 是 HandleTyped 注册的类型信息，skip 用于记录调用方注册路由的源码位置
+func (s *Srv) handle(cmd string, middleware, handlers []HandlerFunc, typed *typedInfo, skip int) {
 	if len(handlers) == 0 {
-		return s
-	}
-	hs, ok := srv.routes[cmd]
-	if ok {
-		hs = append(hs, handlers...)
-	} else {
-		hs = handlers
+		return
 	}
-	routeMu.Lock()
-	srv.routes[cmd] = hs
-	routeMu.Unlock()
+	file, line := callerSource(skip)
+	s.router.add(cmd, &registration{
+		middleware: middleware,
+		handlers:   handlers,
+		file:       file,
+		line:       line,
+		typed:      typed,
+	})
+}
+
+// SetDebugOutput 设置调试信息的输出，默认为 os.Stdout，设置为 nil 则不输出
+// 调试信息如 Run 启动时打印的路由表
+func (s *Srv) SetDebugOutput(w io.Writer) *Srv {
+	s.debugOutput = w
 	return s
 }
 
@@ -125,17 +206,20 @@ func (s *Srv) Push(sid string, resp *Response) error {
 // PushServer 往指定适配器的 sid 推送消息
 func (s *Srv) PushServer(server ServerAdapter, sid string, resp *Response) error {
 	resp.fill()
-	return server.Write(sid, resp)
-}
-
-// Broadcast 往所有可用的会话推送消息
-func (s *Srv) Broadcast(resp *Response) {
-	// resp.fill()
-	for _, server := range s.Server {
-		for _, sid := range s.GetAllSID() {
-			server.Write(sid, resp)
+	err := server.Write(sid, resp)
+	switch {
+	case err == nil:
+		// 通过发送队列写入的消息在写入连接后才统计
+		if _, queued := server.(QueueAdapter); !queued {
+			s.metrics.pushed(resp, nil)
 		}
+		s.logger.Log(LevelDebug, "push", "sid", sid, "cmd", resp.Cmd, "seqno", resp.Seqno)
+	case !reportedByQueue(err): // 发送队列丢弃的消息已经通过 WriteError 记录
+		s.metrics.pushed(resp, err)
+		s.logger.Log(LevelWarn, "push failed", "sid", sid, "cmd", resp.Cmd, "error", err)
+		s.pushFailed(sid, resp, err)
 	}
+	return err
 }
 
 // Close 关闭指定会话 SID 的连接
@@ -149,7 +233,7 @@ func (s *Srv) Close(sid string) error {
 
 // CloseWithServer 关闭指定适配器的指定sid，该方法效率比 Close 高
 func (s *Srv) CloseWithServer(server ServerAdapter, sid string) error {
-	return server.Close(sid)
+	return s.closeWithReason(server, sid, CloseReasonServer)
 }
 
 // GetState 获取指定会话的指定状态值
@@ -170,7 +254,7 @@ func (s *Srv) NewContext(server ServerAdapter, sid string, req *Request) *Contex
 			Request: req,
 			Cmd:     req.Cmd,
 			Seqno:   req.Seqno,
-			Code:    -1,
+			Code:    CodeUnsupportCmd,
 			Msg:     msgUnsupportCmd,
 			Data:    struct{}{},
 		},
@@ -178,14 +262,21 @@ func (s *Srv) NewContext(server ServerAdapter, sid string, req *Request) *Contex
 		Srv:    s,
 		Server: server,
 	}
+	if s.requestTimeout > 0 {
+		ctx.ctx, ctx.cancel = context.WithTimeout(s.baseCtx, s.requestTimeout)
+	} else {
+		ctx.ctx, ctx.cancel = context.WithCancel(s.baseCtx)
+	}
 
-	routeHandlers, ok := s.routes[req.Cmd]
+	rt, params := s.router.match(req.Cmd)
 	var handlers []HandlerFunc
-	if ok {
-		handlers = make([]HandlerFunc, 0, len(s.middleware)+len(routeHandlers)+len(s.internalMiddleware))
+	if rt != nil {
+		handlers = make([]HandlerFunc, 0, len(s.middleware)+len(rt.handlers)+len(s.internalMiddleware))
 		handlers = append(handlers, s.middleware...)
 		handlers = append(handlers, s.internalMiddleware...)
-		handlers = append(handlers, routeHandlers...)
+		handlers = append(handlers, rt.handlers...)
+		ctx.params = params
+		ctx.route = rt.cmd
 		ctx.OK() // 匹配到了路由，但是 handler 没有设置响应
 	} else {
 		handlers = make([]HandlerFunc, 0, len(s.middleware)+1)
@@ -198,56 +289,216 @@ func (s *Srv) NewContext(server ServerAdapter, sid string, req *Request) *Contex
 
 // CallContext 调用上下文，触发上下文中间件
 // 应该在实现 adapter 时才有用
+// 如果消息是 Srv.Request 等待的回复，则不会执行处理函数，直接响应成功
+// 服务关闭中时，除了 CmdClosed 以外的消息都不会再执行处理函数
+// 处理函数执行完成后，上下文的 context.Context 会被取消
 func (s *Srv) CallContext(ctx *Context) {
+	atomic.AddInt64(&s.inFlight, 1)
+	defer atomic.AddInt64(&s.inFlight, -1)
+	s.trackContext(ctx)
+	defer s.untrackContext(ctx)
+	// 服务端请求的回复，不执行路由
+	if s.pending.resolve(ctx.SID, ctx.Request) {
+		ctx.OK()
+		return
+	}
+	if !isInternalCmd(ctx.Cmd) {
+		if !ctx.received {
+			s.metrics.read(ctx.Cmd)
+		}
+		start := time.Now()
+		parent := ctx.spanContext()
+		if !parent.IsValid() {
+			parent = ParseSpanContext(ctx.Request.Trace)
+		}
+		span := s.startSpan(parent, "cs.handle", "sid", ctx.SID, "cmd", ctx.metricCmd())
+		ctx.span = span
+		defer func() {
+			ctx.Response.Trace = span.Context().String()
+			span.End()
+			s.metrics.handled(ctx.metricCmd(), ctx.Response.Code, time.Since(start))
+		}()
+	}
+	if s.shuttingDown() && ctx.Request.Cmd != CmdClosed {
+		ctx.Resp(CodeUnsupportCmd, msgServerClosed)
+		return
+	}
+	if !s.authorize(ctx) {
+		return
+	}
+	if ctx.connecting {
+		s.onSidConnected(ctx.Server, ctx.SID)
+	}
 	for !ctx.handlerAbort && ctx.handlerIndex < len(ctx.handlers) {
 		ctx.Next()
 	}
 }
 
-// 当有新的会话SID产生时触发，依赖内置命令 CmdConnected 实现
-func (s *Srv) onSidConnected(sid string) {}
+// 记录正在执行的请求上下文，用于会话关闭时取消
+func (s *Srv) trackContext(ctx *Context) {
+	s.activeCtxMu.Lock()
+	ctxs, ok := s.activeCtx[ctx.SID]
+	if !ok {
+		ctxs = map[*Context]struct{}{}
+		s.activeCtx[ctx.SID] = ctxs
+	}
+	ctxs[ctx] = struct{}{}
+	s.activeCtxMu.Unlock()
+}
+
+func (s *Srv) untrackContext(ctx *Context) {
+	s.activeCtxMu.Lock()
+	if ctxs, ok := s.activeCtx[ctx.SID]; ok {
+		delete(ctxs, ctx)
+		if len(ctxs) == 0 {
+			delete(s.activeCtx, ctx.SID)
+		}
+	}
+	s.activeCtxMu.Unlock()
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+}
+
+// 取消指定会话所有正在执行的请求上下文
+func (s *Srv) cancelSession(sid string) {
+	s.activeCtxMu.Lock()
+	ctxs := s.activeCtx[sid]
+	delete(s.activeCtx, sid)
+	s.activeCtxMu.Unlock()
+	for ctx := range ctxs {
+		if ctx.cancel != nil {
+			ctx.cancel()
+		}
+	}
+}
 
 // 当有会话SID关闭时触发，依赖内置命令 CmdClosed 实现
 func (s *Srv) onSidClosed(sid string) {
+	reason := s.takeCloseReason(sid)
+	for _, hook := range s.closeUserHooks {
+		hook(sid, reason)
+	}
 	s.state.destroySid(sid)
+	s.rooms.removeSid(sid)
+	s.users.removeSid(sid)
+	s.removeAuthState(sid)
+	s.closeHooksMu.RLock()
+	hooks := s.closeHooks
+	s.closeHooksMu.RUnlock()
+	for _, hook := range hooks {
+		hook(sid)
+	}
+}
+
+// 注册会话关闭时的内部回调
+func (s *Srv) onClose(hook func(sid string)) {
+	s.closeHooksMu.Lock()
+	s.closeHooks = append(s.closeHooks, hook)
+	s.closeHooksMu.Unlock()
+}
+
+// 启动读取适配器消息的循环，调用方需持有 serverMu
+func (s *Srv) serve(server ServerAdapter) {
+	sv := &serving{server: server, done: make(chan struct{})}
+	s.serving = append(s.serving, sv)
+	go func() {
+		defer close(sv.done)
+		s.startServer(server)
+	}()
 }
 
 // 接收服务器适配器产生的消息，并执行路由处理函数
 func (s *Srv) startServer(server ServerAdapter) {
 	for {
 		sid, req, err := server.Read(s)
+		if err == nil && req == nil {
+			err = errors.New("unexpected request data")
+		}
 		if err != nil {
-			s.runErr <- err
+			if s.shuttingDown() {
+				return
+			}
+			s.adapterFailed(server, err)
+			select {
+			case s.runErr <- err:
+			case <-s.done:
+			}
 			return
 		}
-		if req == nil {
-			s.runErr <- errors.New("unexpected request data")
-			return
+		// 服务端请求的回复，不执行路由
+		if s.pending.resolve(sid, req) {
+			continue
+		}
+		// 读取时统计收到的消息，包括被调度器拒绝的消息
+		if !isInternalCmd(req.Cmd) {
+			s.metrics.read(req.Cmd)
+		}
+		// 关闭中只处理会话关闭的消息
+		if s.shuttingDown() && req.Cmd != CmdClosed {
+			continue
+		}
+		// 维护会话注册表，会话已关闭时取消该会话正在执行的请求
+		switch req.Cmd {
+		case CmdConnected:
+			s.logger.Log(LevelDebug, "session connected", "sid", sid, "adapter", adapterName(server))
+			s.addSession(server, sid)
+		case CmdClosed:
+			s.logger.Log(LevelDebug, "session closed", "sid", sid, "adapter", adapterName(server))
+			s.removeSession(sid)
+			s.cancelSession(sid)
+			s.pending.closeSid(sid)
 		}
 
 		// handler cmd
-		go func(sid string, req *Request) {
-			ctx := s.NewContext(server, sid, req)
+		atomic.AddInt64(&s.inFlight, 1)
+		ok := s.dispatcher.dispatch(sid, req, func(slot *flightSlot) {
+			defer atomic.AddInt64(&s.inFlight, -1)
+			s.handleMessage(server, sid, req, slot)
+		})
+		if !ok {
+			atomic.AddInt64(&s.inFlight, -1)
+			s.PushServer(server, sid, &Response{
+				Request: req,
+				Cmd:     req.Cmd,
+				Seqno:   req.Seqno,
+				Code:    s.dispatcher.conf.OverflowCode,
+				Msg:     s.dispatcher.conf.OverflowMsg,
+				Data:    struct{}{},
+			})
+		}
+	}
+}
 
-			s.CallContext(ctx) // 为什么会卡死在这不回复
+// 执行适配器读取到的消息，并回复响应
+func (s *Srv) handleMessage(server ServerAdapter, sid string, req *Request, slot *flightSlot) {
+	ctx := s.NewContext(server, sid, req)
+	ctx.connecting = req.Cmd == CmdConnected
+	ctx.received = true
+	if slot != nil {
+		ctx.ctx = context.WithValue(ctx.ctx, flightSlotKey{}, slot)
+	}
+	if !isInternalCmd(req.Cmd) {
+		span := s.startSpan(ParseSpanContext(req.Trace), "cs.receive", "sid", sid, "cmd", req.Cmd)
+		defer span.End()
+		ctx.span = span
+	}
 
-			// internal will not response
-			if req.Cmd != CmdConnected &&
-				req.Cmd != CmdClosed &&
-				req.Cmd != CmdHeartbeat {
+	s.CallContext(ctx) // 为什么会卡死在这不回复
 
-				s.PushServer(server, sid, ctx.Response)
+	// internal will not response
+	if req.Cmd != CmdConnected &&
+		req.Cmd != CmdClosed &&
+		req.Cmd != CmdHeartbeat &&
+		!ctx.responded {
 
-			}
+		s.PushServer(server, sid, ctx.Response)
 
-			// call internal hooks
-			switch req.Cmd {
-			case CmdConnected:
-				s.onSidConnected(sid)
-			case CmdClosed:
-				s.onSidClosed(sid)
-			}
-		}(sid, req)
+	}
+
+	// call internal hooks
+	if req.Cmd == CmdClosed {
+		s.onSidClosed(sid)
 	}
 }
 
@@ -260,17 +511,6 @@ func (s *Srv) GetAllSID() []string {
 	return sids
 }
 
-func (s *Srv) getSidServer(sid string) (ServerAdapter, error) {
-	for _, server := range s.Server {
-		for _, id := range server.GetAllSID() {
-			if id == sid {
-				return server, nil
-			}
-		}
-	}
-	return nil, errors.New("the sid is destroy")
-}
-
 func (s *Srv) callPushMiddleware(c *Context, resp *Response) (*Context, error) {
 	if len(s.pushMiddleware) == 0 {
 		return c, nil
@@ -281,6 +521,7 @@ func (s *Srv) callPushMiddleware(c *Context, resp *Response) (*Context, error) {
 	ctx.Response.Msg = resp.Msg
 	ctx.Response.Data = resp.Data
 	ctx.Response.Seqno = randomString(12)
+	ctx.Response.Trace = ctx.spanContext().String()
 
 	for _, h := range s.pushMiddleware {
 		if err := h(ctx); err != nil {
@@ -292,24 +533,26 @@ func (s *Srv) callPushMiddleware(c *Context, resp *Response) (*Context, error) {
 }
 
 // Run 开始接收命令消息，运行框架，会阻塞当前 goroutine
+// 调用 Shutdown 关闭服务后返回 ErrServerClosed
 func (s *Srv) Run() error {
-	mdlLen := len(s.middleware)
-	for cmd, hs := range s.routes {
-		text := ""
-		if len(hs) > 0 {
-			h := hs[len(hs)-1]
-			text = fmt.Sprintf("[SRV-debug] %s => %s[%d handlers]", cmd, funcName(h), len(hs)+mdlLen)
-		} else {
-			text = fmt.Sprintf("[SRV-debug] %s => [%d handlers]", cmd, mdlLen)
-		}
-		fmt.Println(text)
+	if s.shuttingDown() {
+		return ErrServerClosed
 	}
+	s.printRoutes()
 	s.serverMu.Lock()
+	if s.shuttingDown() {
+		s.serverMu.Unlock()
+		return ErrServerClosed
+	}
 	s.isRunning = true
 	for _, server := range s.Server {
-		go s.startServer(server)
+		s.serve(server)
 	}
 	s.serverMu.Unlock()
-	err := <-s.runErr
-	return err
+	select {
+	case err := <-s.runErr:
+		return err
+	case <-s.done:
+		return ErrServerClosed
+	}
 }
@@ -1,10 +1,13 @@
 package cs
 
+import "time"
+
 // SrvGroup 路由组，用于实现分组路由
 type SrvGroup struct {
 	parent     *SrvGroup
 	srv        *Srv
 	middleware []HandlerFunc
+	prefix     string
 }
 
 // Use 在当前分组添加中间件
@@ -13,6 +16,20 @@ func (s *SrvGroup) Use(handlers ...HandlerFunc) *SrvGroup {
 	return s
 }
 
+// Prefix 设置分组的命令前缀，在该分组下注册的路由都会加上前缀，嵌套分组的前缀会叠加
+// 内置命令如 CmdClosed 不会加前缀
+// srv.Group().Prefix("order.").Handle("create", h) 注册的命令为 order.create
+func (s *SrvGroup) Prefix(prefix string) *SrvGroup {
+	s.prefix = prefix
+	return s
+}
+
+// Timeout 设置该分组下路由的处理函数超时，参数同 cs.Timeout
+// 会覆盖全局 Timeout 中间件的设置，如果嵌套分组都设置了，以最里层的为准
+func (s *SrvGroup) Timeout(d time.Duration, args ...interface{}) *SrvGroup {
+	return s.Use(Timeout(d, args...))
+}
+
 // Group 基于当前分组继续创建分组路由
 func (s *SrvGroup) Group(handlers ...HandlerFunc) *SrvGroup {
 	return &SrvGroup{
@@ -24,19 +41,35 @@ func (s *SrvGroup) Group(handlers ...HandlerFunc) *SrvGroup {
 
 // Handle 注册路由
 func (s *SrvGroup) Handle(cmd string, handlers ...HandlerFunc) *SrvGroup {
-	s.srv.Handle(cmd, s.combineHandlers(handlers)...)
+	if !isInternalCmd(cmd) {
+		cmd = s.fullPrefix() + cmd
+	}
+	s.srv.handle(cmd, s.combineHandlers(nil), handlers, nil, 2)
+	return s
+}
+
+// HandleTyped 注册使用 NewTypedRoute 创建的路由，见 Srv.HandleTyped
+func (s *SrvGroup) HandleTyped(cmd string, route TypedRoute, middleware ...HandlerFunc) *SrvGroup {
+	if !isInternalCmd(cmd) {
+		cmd = s.fullPrefix() + cmd
+	}
+	s.srv.handle(cmd, s.combineHandlers(nil), append(append([]HandlerFunc{}, middleware...), route.handler), route.typed, 2)
 	return s
 }
 
+// 包含所有上级分组的命令前缀
+func (s *SrvGroup) fullPrefix() string {
+	if s.parent == nil {
+		return s.prefix
+	}
+	return s.parent.fullPrefix() + s.prefix
+}
+
 // 在注册路由前用于计算路由组的处理函数，不包含顶级的中间件
 func (s *SrvGroup) combineHandlers(handlers []HandlerFunc) []HandlerFunc {
-	size := len(s.middleware) + len(handlers)
-	if s.parent != nil {
-		size += len(s.parent.middleware)
-	}
-	hs := make([]HandlerFunc, 0, size)
+	hs := make([]HandlerFunc, 0, len(s.middleware)+len(handlers))
 	if s.parent != nil {
-		hs = append(hs, s.parent.middleware...)
+		hs = append(hs, s.parent.combineHandlers(nil)...)
 	}
 	hs = append(hs, s.middleware...)
 	hs = append(hs, handlers...)
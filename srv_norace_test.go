@@ -10,11 +10,11 @@ import (
 )
 
 func TestSrv_MutilServer(t *testing.T) {
-	server1 := &testAdapter{request: []*cs.Request{{"a", "1", []byte{1}}}, sid: "1"}
-	server2 := &testAdapter{request: []*cs.Request{{"a", "2", []byte{2}}}, sid: "2"}
-	server3 := &testAdapter{request: []*cs.Request{{"a", "3", []byte{3}}}, sid: "3"}
-	server4 := &testAdapter{request: []*cs.Request{{"a", "4", []byte{4}}}, sid: "4"}
-	server5 := &testAdapter{request: []*cs.Request{{"a", "5", []byte{5}}}, sid: "5"}
+	server1 := &testAdapter{request: []*cs.Request{{Cmd: "a", Seqno: "1", RawData: []byte{1}}}, sid: "1"}
+	server2 := &testAdapter{request: []*cs.Request{{Cmd: "a", Seqno: "2", RawData: []byte{2}}}, sid: "2"}
+	server3 := &testAdapter{request: []*cs.Request{{Cmd: "a", Seqno: "3", RawData: []byte{3}}}, sid: "3"}
+	server4 := &testAdapter{request: []*cs.Request{{Cmd: "a", Seqno: "4", RawData: []byte{4}}}, sid: "4"}
+	server5 := &testAdapter{request: []*cs.Request{{Cmd: "a", Seqno: "5", RawData: []byte{5}}}, sid: "5"}
 	gtest.C(t, func(t *gtest.T) {
 		srv := cs.New(server1, server2)
 		seqnos := []string{} // 这个变量会产生数据竞争，数据竞争就会导致里面数组的顺序不确定，但这只是测试代码
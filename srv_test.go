@@ -1,9 +1,14 @@
 package cs_test
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -56,10 +61,10 @@ func (a *testAdapter) Debug(v ...interface{}) {
 func TestSrv_MiddlewareCall(t *testing.T) {
 	srv := cs.New(&testAdapter{
 		request: []*cs.Request{
-			{"a", "", nil},
-			{"b", "", nil},
-			{"c", "", nil},
-			{"d", "", nil},
+			{Cmd: "a", Seqno: "", RawData: nil},
+			{Cmd: "b", Seqno: "", RawData: nil},
+			{Cmd: "c", Seqno: "", RawData: nil},
+			{Cmd: "d", Seqno: "", RawData: nil},
 		},
 	})
 
@@ -131,8 +136,8 @@ func TestSrv_MiddlewareCall(t *testing.T) {
 func TestSrv_Parse(t *testing.T) {
 	srv := cs.New(&testAdapter{
 		request: []*cs.Request{
-			{"a", "1", []byte(`{"x":1}`)},
-			{"b", "2", []byte(`[{"y":2},{"z":3}]`)},
+			{Cmd: "a", Seqno: "1", RawData: []byte(`{"x":1}`)},
+			{Cmd: "b", Seqno: "2", RawData: []byte(`[{"y":2},{"z":3}]`)},
 		},
 	})
 	gtest.C(t, func(t *gtest.T) {
@@ -183,16 +188,16 @@ func TestSrv_Parse(t *testing.T) {
 func TestSrv_Response(t *testing.T) {
 	server1 := &testAdapter{
 		request: []*cs.Request{
-			{cs.CmdConnected, "", nil},
-			{"a", "", nil},
-			{"b", "", nil},
-			{"c", "", nil},
-			{cs.CmdHeartbeat, "", nil},
-			{"d", "", nil},
-			{"e", "", nil},
-			{"f", "", nil},
-			{cs.CmdClosed, "", nil},
-			{"g", "", nil},
+			{Cmd: cs.CmdConnected, Seqno: "", RawData: nil},
+			{Cmd: "a", Seqno: "", RawData: nil},
+			{Cmd: "b", Seqno: "", RawData: nil},
+			{Cmd: "c", Seqno: "", RawData: nil},
+			{Cmd: cs.CmdHeartbeat, Seqno: "", RawData: nil},
+			{Cmd: "d", Seqno: "", RawData: nil},
+			{Cmd: "e", Seqno: "", RawData: nil},
+			{Cmd: "f", Seqno: "", RawData: nil},
+			{Cmd: cs.CmdClosed, Seqno: "", RawData: nil},
+			{Cmd: "g", Seqno: "", RawData: nil},
 		},
 		sid: "1",
 	}
@@ -267,8 +272,8 @@ func TestSrv_Response(t *testing.T) {
 func TestSrv_State(t *testing.T) {
 	srv := cs.New(&testAdapter{
 		request: []*cs.Request{
-			{"a", "1", []byte(`{"x":1}`)},
-			{"b", "2", []byte(`[{"y":2}]`)},
+			{Cmd: "a", Seqno: "1", RawData: []byte(`{"x":1}`)},
+			{Cmd: "b", Seqno: "2", RawData: []byte(`[{"y":2}]`)},
 		},
 	})
 	uid := 10
@@ -291,10 +296,10 @@ func TestSrv_State(t *testing.T) {
 func TestSrv_Exit(t *testing.T) {
 	srv := cs.New(&testAdapter{
 		request: []*cs.Request{
-			{"a", "1", []byte(`{"x":1}`)},
-			{"b", "2", []byte(`[{"y":2}]`)},
-			{"c", "3", nil},
-			{"d", "4", nil},
+			{Cmd: "a", Seqno: "1", RawData: []byte(`{"x":1}`)},
+			{Cmd: "b", Seqno: "2", RawData: []byte(`[{"y":2}]`)},
+			{Cmd: "c", Seqno: "3", RawData: nil},
+			{Cmd: "d", Seqno: "4", RawData: nil},
 		},
 	})
 	gtest.C(t, func(t *gtest.T) {
@@ -337,3 +342,731 @@ func TestSrv_Exit(t *testing.T) {
 	})
 
 }
+
+type chanAdapter struct {
+	receive chan *cs.Request
+	written chan *cs.Response // 不为空时记录推送的消息
+	done    chan struct{}
+	closed  chan string
+	sids    []string
+	mu      sync.Mutex
+}
+
+func newChanAdapter(sids ...string) *chanAdapter {
+	return &chanAdapter{
+		receive: make(chan *cs.Request, 10),
+		done:    make(chan struct{}),
+		closed:  make(chan string, 10),
+		sids:    sids,
+	}
+}
+
+func (a *chanAdapter) Read(r *cs.Srv) (string, *cs.Request, error) {
+	select {
+	case m := <-a.receive:
+		return "1", m, nil
+	case <-a.done:
+		select {
+		case m := <-a.receive:
+			return "1", m, nil
+		default:
+			return "", nil, errors.New("shutdown")
+		}
+	}
+}
+func (a *chanAdapter) Write(sid string, resp *cs.Response) error {
+	if a.written != nil {
+		a.written <- resp
+	}
+	return nil
+}
+func (a *chanAdapter) Close(sid string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, id := range a.sids {
+		if id == sid {
+			a.sids = append(a.sids[:i], a.sids[i+1:]...)
+			a.receive <- &cs.Request{Cmd: cs.CmdClosed}
+			return nil
+		}
+	}
+	return errors.New("closed")
+}
+func (a *chanAdapter) GetAllSID() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string{}, a.sids...)
+}
+func (a *chanAdapter) Shutdown(ctx context.Context) error {
+	close(a.done)
+	return nil
+}
+
+func TestSrv_Shutdown(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		srv := cs.New(server)
+		var finished, closed int32
+		srv.Handle("slow", func(c *cs.Context) {
+			time.Sleep(50 * time.Millisecond)
+			atomic.AddInt32(&finished, 1)
+		})
+		srv.Handle(cs.CmdClosed, func(c *cs.Context) {
+			atomic.AddInt32(&closed, 1)
+		})
+		runErr := make(chan error, 1)
+		go func() { runErr <- srv.Run() }()
+		server.receive <- &cs.Request{Cmd: "slow"}
+		time.Sleep(10 * time.Millisecond)
+
+		t.Assert(srv.Shutdown(context.Background()), nil)
+		t.Assert(atomic.LoadInt32(&finished), 1)
+		t.Assert(atomic.LoadInt32(&closed), 1)
+		t.Assert(<-runErr, cs.ErrServerClosed)
+		t.Assert(srv.Shutdown(context.Background()), cs.ErrServerClosed)
+		t.Assert(srv.Run(), cs.ErrServerClosed)
+	})
+}
+
+func TestSrv_ShutdownTimeout(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter()
+		srv := cs.New(server)
+		srv.Handle("slow", func(c *cs.Context) {
+			time.Sleep(200 * time.Millisecond)
+		})
+		go srv.Run()
+		server.receive <- &cs.Request{Cmd: "slow"}
+		time.Sleep(10 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		t.Assert(srv.Shutdown(ctx), context.DeadlineExceeded)
+	})
+}
+
+func TestContext_Context(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		srv := cs.New(server)
+		srv.SetRequestTimeout(time.Second)
+		type ctxKey struct{}
+		srv.Use(func(c *cs.Context) {
+			c.WithContext(context.WithValue(c.Context(), ctxKey{}, "v"))
+			c.Next()
+		})
+		waitErr := make(chan error, 1)
+		srv.Handle("wait", func(c *cs.Context) {
+			t.Assert(c.Context().Value(ctxKey{}), "v")
+			_, ok := c.Context().Deadline()
+			t.Assert(ok, true)
+			<-c.Context().Done()
+			waitErr <- c.Context().Err()
+		})
+		go srv.Run()
+		server.receive <- &cs.Request{Cmd: "wait"}
+		time.Sleep(20 * time.Millisecond)
+		server.receive <- &cs.Request{Cmd: cs.CmdClosed}
+
+		select {
+		case err := <-waitErr:
+			t.Assert(err, context.Canceled)
+		case <-time.After(500 * time.Millisecond):
+			t.Error("context not canceled on session closed")
+		}
+	})
+}
+
+func TestSrv_Timeout(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		srv := cs.New(server)
+		resps := make(chan *cs.Response, 10)
+		srv.Use(func(c *cs.Context) {
+			c.Next()
+			resps <- c.Response
+		})
+		srv.Use(cs.Timeout(20*time.Millisecond, 504))
+		canceled := make(chan error, 1)
+		srv.Handle("slow", func(c *cs.Context) {
+			<-c.Context().Done()
+			canceled <- c.Context().Err()
+			c.OK("late")
+		})
+		srv.Handle("fast", func(c *cs.Context) {
+			c.OK("fast")
+		})
+		srv.Group().Timeout(200*time.Millisecond, "too slow").Handle("long", func(c *cs.Context) {
+			time.Sleep(50 * time.Millisecond)
+			c.OK("long")
+		})
+		srv.Handle("exit", cs.Timeout(time.Second), func(c *cs.Context) {
+			c.Resp(7, "exit")
+			c.Exit(7)
+		})
+		go srv.Run()
+
+		server.receive <- &cs.Request{Cmd: "slow"}
+		resp := <-resps
+		t.Assert(resp.Code, 504)
+		t.Assert(resp.Msg, "handler timeout")
+		t.Assert(<-canceled, context.Canceled)
+		time.Sleep(10 * time.Millisecond)
+		t.Assert(resp.Data, struct{}{})
+
+		server.receive <- &cs.Request{Cmd: "fast"}
+		resp = <-resps
+		t.Assert(resp.Code, 0)
+		t.Assert(resp.Data, "fast")
+
+		server.receive <- &cs.Request{Cmd: "long"}
+		resp = <-resps
+		t.Assert(resp.Code, 0)
+		t.Assert(resp.Data, "long")
+
+		server.receive <- &cs.Request{Cmd: "exit"}
+		resp = <-resps
+		t.Assert(resp.Code, 7)
+		t.Assert(resp.Msg, "exit")
+	})
+}
+
+func TestSrv_TimeoutLatePanic(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		panics := make(chan interface{}, 1)
+		srv.OnPanic(func(c *cs.Context, v interface{}, stack []byte) {
+			panics <- v
+		})
+		srv.Use(cs.Timeout(20 * time.Millisecond))
+		srv.Handle("slow", func(c *cs.Context) {
+			<-c.Context().Done()
+			panic("late")
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "slow"}
+		t.Assert((<-server.written).Code, cs.CodeTimeout)
+		// 超时之后的 panic 也会报告
+		select {
+		case v := <-panics:
+			t.Assert(v, "late")
+		case <-time.After(time.Second):
+			t.Error("late panic not reported")
+		}
+	})
+}
+
+func TestSrv_PatternRoute(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		srv := cs.New(server)
+		resps := make(chan *cs.Response, 10)
+		srv.Use(func(c *cs.Context) {
+			c.Next()
+			resps <- c.Response
+		})
+		srv.Handle("order.*", func(c *cs.Context) {
+			c.OK("wildcard")
+		})
+		srv.Handle("order.:id", func(c *cs.Context) {
+			c.OK("param " + c.Param("id"))
+		})
+		srv.Handle("order.create", func(c *cs.Context) {
+			c.OK("exact")
+		})
+		srv.Handle("room.:id.join", func(c *cs.Context) {
+			c.OK("join " + c.Param("id"))
+		})
+		order := srv.Group(func(c *cs.Context) {
+			c.Next()
+			c.Msg = "group"
+		}).Prefix("shop.")
+		order.Group().Prefix("item.").Handle("add", func(c *cs.Context) {
+			c.OK("item add")
+		})
+		go srv.Run()
+
+		for _, v := range [][]string{
+			{"order.create", "exact", "ok"},
+			{"order.100", "param 100", "ok"},
+			{"order.item.add", "wildcard", "ok"},
+			{"room.7.join", "join 7", "ok"},
+			{"shop.item.add", "item add", "group"},
+		} {
+			server.receive <- &cs.Request{Cmd: v[0]}
+			resp := <-resps
+			t.Assert(resp.Code, 0)
+			t.Assert(resp.Data, v[1])
+			t.Assert(resp.Msg, v[2])
+		}
+		for _, cmd := range []string{"order", "room.7", "item.add"} {
+			server.receive <- &cs.Request{Cmd: cmd}
+			resp := <-resps
+			t.Assert(resp.Code, cs.CodeUnsupportCmd)
+		}
+	})
+}
+
+func TestSrv_Routes(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		srv := cs.New()
+		buf := bytes.NewBuffer(nil)
+		srv.SetDebugOutput(buf)
+		srv.Use(cs.Recover())
+		srv.Handle("a", routeHandlerA)
+		srv.Group(routeMiddleware).Prefix("g.").Handle("b", routeHandlerA, routeHandlerB)
+		srv.Handle("c.*", routeHandlerB)
+
+		routes := srv.Routes()
+		t.Assert(len(routes), 3)
+		t.Assert(routes[0].Cmd, "a")
+		t.Assert(routes[0].Handler, "github.com/eyasliu/cs_test.routeHandlerA")
+		t.Assert(len(routes[0].Middleware), 1)
+		t.Assert(strings.HasSuffix(routes[0].File, "srv_test.go"), true)
+		t.AssertGT(routes[0].Line, 0)
+
+		t.Assert(routes[1].Cmd, "g.b")
+		t.Assert(routes[1].Handlers, []string{
+			"github.com/eyasliu/cs_test.routeHandlerA",
+			"github.com/eyasliu/cs_test.routeHandlerB",
+		})
+		t.Assert(routes[1].Middleware[1], "github.com/eyasliu/cs_test.routeMiddleware")
+		t.Assert(routes[1].Line, routes[0].Line+1)
+		t.Assert(routes[2].Cmd, "c.*")
+
+		srv.AddServer(&testAdapter{})
+		t.AssertNE(srv.Run(), nil)
+		t.Assert(strings.Count(buf.String(), "[SRV-debug]"), 3)
+
+		buf.Reset()
+		srv.SetDebugOutput(nil)
+		t.AssertNE(srv.Run(), nil)
+		t.Assert(buf.Len(), 0)
+	})
+}
+
+func routeHandlerA(c *cs.Context) {}
+func routeHandlerB(c *cs.Context) {}
+func routeMiddleware(c *cs.Context) {
+	c.Next()
+}
+
+type typedCodeErr struct{}
+
+func (typedCodeErr) Error() string { return "coded" }
+func (typedCodeErr) ErrCode() int  { return 403 }
+
+func TestSrv_Typed(t *testing.T) {
+	type req struct {
+		Name string `p:"name" v:"required"`
+	}
+	type resp struct {
+		Hello string `json:"hello"`
+	}
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		srv := cs.New(server)
+		resps := make(chan *cs.Response, 10)
+		srv.Use(func(c *cs.Context) {
+			c.Next()
+			resps <- c.Response
+		})
+		srv.HandleTyped("hello", cs.NewTypedRoute(func(c *cs.Context, r *req) (*resp, error) {
+			switch r.Name {
+			case "coded":
+				return nil, fmt.Errorf("wrap: %w", typedCodeErr{})
+			case "err":
+				return nil, errors.New("plain")
+			case "nil":
+				return nil, nil
+			}
+			return &resp{Hello: r.Name}, nil
+		}))
+		srv.Group().Prefix("v1.").HandleTyped("hello", cs.NewTypedRoute(func(c *cs.Context, r *req) (*resp, error) {
+			return nil, nil
+		}), func(c *cs.Context) { c.Next() })
+		srv.Handle("untyped", cs.Typed(func(c *cs.Context, r *req) (*resp, error) {
+			panic("should not be called when registering")
+		}))
+		go srv.Run()
+
+		routes := srv.Routes()
+		t.Assert(routes[0].Request.Name(), "req")
+		t.Assert(routes[0].Response.Name(), "resp")
+		t.Assert(routes[1].Cmd, "v1.hello")
+		t.Assert(len(routes[1].Handlers), 2)
+		t.Assert(routes[1].Request.Name(), "req")
+		// Handle 注册的 Typed 处理函数不记录类型，注册时也不会执行处理函数
+		t.Assert(routes[2].Request, nil)
+
+		for _, v := range []struct {
+			data string
+			code int
+			msg  string
+		}{
+			{`{"name":"cs"}`, 0, "ok"},
+			{`{}`, cs.CodeBadRequest, ""},
+			{`{"name":"coded"}`, 403, "wrap: coded"},
+			{`{"name":"err"}`, cs.CodeError, "plain"},
+			{`{"name":"nil"}`, 0, "ok"},
+		} {
+			server.receive <- &cs.Request{Cmd: "hello", RawData: []byte(v.data)}
+			r := <-resps
+			t.Assert(r.Code, v.code)
+			if v.msg != "" {
+				t.Assert(r.Msg, v.msg)
+			}
+			if v.data == `{"name":"cs"}` {
+				t.Assert(r.Data.(*resp).Hello, "cs")
+			}
+		}
+	})
+}
+
+func TestSrv_Session(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: cs.CmdConnected}
+		time.Sleep(10 * time.Millisecond)
+		t.Assert(srv.SessionCount(), 1)
+		var sids []string
+		srv.RangeSession(func(sid string, s cs.ServerAdapter) bool {
+			t.Assert(s, server)
+			sids = append(sids, sid)
+			return true
+		})
+		t.Assert(sids, []string{"1"})
+		t.Assert(srv.Push("1", &cs.Response{Cmd: "test"}), nil)
+		srv.Join("1", "room")
+
+		server.receive <- &cs.Request{Cmd: cs.CmdClosed}
+		time.Sleep(10 * time.Millisecond)
+		t.Assert(srv.SessionCount(), 0)
+		t.Assert(srv.RoomMembers("room"), []string{})
+	})
+}
+
+// 记录推送消息的适配器
+type pushAdapter struct {
+	sids    []string
+	written map[string][]*cs.Response
+	mu      sync.Mutex
+}
+
+func newPushAdapter(sids ...string) *pushAdapter {
+	return &pushAdapter{sids: sids, written: map[string][]*cs.Response{}}
+}
+
+func (a *pushAdapter) Read(r *cs.Srv) (string, *cs.Request, error) {
+	select {}
+}
+func (a *pushAdapter) Write(sid string, resp *cs.Response) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.written[sid] = append(a.written[sid], resp)
+	return nil
+}
+func (*pushAdapter) Close(sid string) error {
+	return nil
+}
+func (a *pushAdapter) GetAllSID() []string {
+	return a.sids
+}
+func (a *pushAdapter) cmds(sid string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cmds := []string{}
+	for _, resp := range a.written[sid] {
+		cmds = append(cmds, resp.Cmd)
+	}
+	return cmds
+}
+
+func TestSrv_Room(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newPushAdapter("1", "2", "3")
+		srv := cs.New(server)
+		var pushed int32
+		srv.UsePush(func(c *cs.Context) error {
+			atomic.AddInt32(&pushed, 1)
+			return nil
+		})
+		srv.Join("1", "a", "b")
+		srv.Join("2", "a")
+		srv.Join("3", "b")
+		t.Assert(srv.Rooms("1"), []string{"a", "b"})
+		t.Assert(srv.RoomMembers("a"), []string{"1", "2"})
+
+		srv.BroadcastRoom("a", &cs.Response{Cmd: "hello"}, "2")
+		t.Assert(server.cmds("1"), []string{"hello"})
+		t.Assert(server.cmds("2"), []string{})
+		t.Assert(atomic.LoadInt32(&pushed), 1)
+
+		srv.Leave("1", "a")
+		t.Assert(srv.Rooms("1"), []string{"b"})
+		srv.Leave("1")
+		t.Assert(srv.Rooms("1"), []string{})
+		t.Assert(srv.RoomMembers("b"), []string{"3"})
+	})
+}
+
+func TestSrv_User(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newPushAdapter("1", "2", "3")
+		srv := cs.New(server)
+		srv.BindUser("1", "u1")
+		srv.BindUser("2", "u1")
+		srv.BindUser("3", "u2")
+		t.Assert(srv.UserSIDs("u1"), []string{"1", "2"})
+		t.Assert(srv.UserID("3"), "u2")
+
+		t.Assert(srv.PushUser("u1", &cs.Response{Cmd: "hello"}), nil)
+		t.Assert(server.cmds("1"), []string{"hello"})
+		t.Assert(server.cmds("2"), []string{"hello"})
+		t.Assert(server.cmds("3"), []string{})
+
+		srv.BindUser("2", "u2")
+		t.Assert(srv.UserSIDs("u1"), []string{"1"})
+		t.Assert(srv.UserSIDs("u2"), []string{"2", "3"})
+		srv.UnbindUser("1")
+		t.Assert(srv.UserID("1"), "")
+		t.AssertNE(srv.PushUser("u1", &cs.Response{Cmd: "hello"}), nil)
+	})
+}
+
+func TestSrv_Request(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		var routed int32
+		srv.Handle("confirm", func(c *cs.Context) {
+			atomic.AddInt32(&routed, 1)
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+		server.receive <- &cs.Request{Cmd: cs.CmdConnected}
+		time.Sleep(10 * time.Millisecond)
+
+		go func() {
+			push := <-server.written
+			server.receive <- &cs.Request{Cmd: push.Cmd, Seqno: push.Seqno, RawData: []byte(`{"ok":true}`)}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		reply, err := srv.Request(ctx, "1", "confirm", nil)
+		t.Assert(err, nil)
+		t.Assert(string(reply.RawData), `{"ok":true}`)
+		t.Assert(atomic.LoadInt32(&routed), 0)
+
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = srv.Request(ctx, "1", "confirm", nil)
+		t.Assert(err, context.DeadlineExceeded)
+		<-server.written
+
+		go func() {
+			<-server.written
+			server.receive <- &cs.Request{Cmd: cs.CmdClosed}
+		}()
+		_, err = srv.Request(context.Background(), "1", "confirm", nil)
+		t.Assert(err, cs.ErrSessionClosed)
+	})
+}
+
+func TestSrv_Dispatch(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetDispatch(cs.DispatchConfig{Mode: cs.DispatchSerialSID, QueueSize: 1})
+		release := make(chan struct{})
+		srv.Handle("auth", func(c *cs.Context) {
+			<-release
+		})
+		srv.Handle("subscribe", func(c *cs.Context) {})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "auth"}
+		time.Sleep(10 * time.Millisecond)
+		server.receive <- &cs.Request{Cmd: "subscribe"}
+		server.receive <- &cs.Request{Cmd: "subscribe", Seqno: "overflow"}
+
+		resp := <-server.written
+		t.Assert(resp.Seqno, "overflow")
+		t.Assert(resp.Code, cs.CodeBusy)
+
+		close(release)
+		t.Assert((<-server.written).Cmd, "auth")
+		t.Assert((<-server.written).Cmd, "subscribe")
+	})
+}
+
+func TestSrv_DispatchShed(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetDispatch(cs.DispatchConfig{Workers: 2, MaxInFlight: 1, Shed: true})
+		release := make(chan struct{})
+		srv.Handle("slow", func(c *cs.Context) {
+			<-release
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "slow", Seqno: "1"}
+		time.Sleep(10 * time.Millisecond)
+		server.receive <- &cs.Request{Cmd: "slow", Seqno: "2"}
+		resp := <-server.written
+		t.Assert(resp.Seqno, "2")
+		t.Assert(resp.Code, cs.CodeBusy)
+		stats := srv.DispatchStats()
+		t.Assert(stats.Running, 1)
+		t.Assert(stats.Shed, 1)
+
+		close(release)
+		t.Assert((<-server.written).Seqno, "1")
+		time.Sleep(10 * time.Millisecond)
+		t.Assert(srv.DispatchStats().Handled, 1)
+	})
+}
+
+func TestSrv_DispatchSerialShed(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetDispatch(cs.DispatchConfig{Mode: cs.DispatchSerialKey, Workers: 1, Shed: true})
+		release := make(chan struct{})
+		srv.Handle("slow", func(c *cs.Context) {
+			<-release
+		})
+		srv.Handle("other", func(c *cs.Context) {})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "slow", Seqno: "1"}
+		time.Sleep(10 * time.Millisecond)
+		// 正在执行的队列继续排队，空闲的队列没有 worker 可用时丢弃
+		server.receive <- &cs.Request{Cmd: "slow", Seqno: "2"}
+		server.receive <- &cs.Request{Cmd: "other", Seqno: "3"}
+		resp := <-server.written
+		t.Assert(resp.Seqno, "3")
+		t.Assert(resp.Code, cs.CodeBusy)
+		t.Assert(srv.DispatchStats().Shed, 1)
+
+		close(release)
+		t.Assert((<-server.written).Seqno, "1")
+		t.Assert((<-server.written).Seqno, "2")
+	})
+}
+
+func TestSrv_DispatchRequestInFlight(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetDispatch(cs.DispatchConfig{MaxInFlight: 1})
+		srv.Handle("pay", func(c *cs.Context) {
+			ctx, cancel := context.WithTimeout(c.Context(), time.Second)
+			defer cancel()
+			reply, err := c.Srv.Request(ctx, c.SID, "confirm", nil)
+			if err != nil {
+				c.Err(err, 1)
+				return
+			}
+			c.OK(string(reply.RawData))
+		})
+		srv.Handle("ping", func(c *cs.Context) {
+			c.OK("pong")
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+		server.receive <- &cs.Request{Cmd: cs.CmdConnected}
+
+		server.receive <- &cs.Request{Cmd: "pay", Seqno: "1"}
+		push := <-server.written
+		t.Assert(push.Cmd, "confirm")
+		// 等待回复期间不占用 MaxInFlight，读取消息不会被阻塞
+		server.receive <- &cs.Request{Cmd: "ping", Seqno: "2"}
+		resp := <-server.written
+		t.Assert(resp.Seqno, "2")
+		t.Assert(resp.Data, "pong")
+		server.receive <- &cs.Request{Cmd: "confirm", Seqno: push.Seqno, RawData: []byte(`ok`)}
+		resp = <-server.written
+		t.Assert(resp.Seqno, "1")
+		t.Assert(resp.Code, 0)
+		t.Assert(resp.Data, "ok")
+	})
+}
+
+func TestSrv_Broadcast(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		a := newPushAdapter("1", "2")
+		b := newPushAdapter("3")
+		srv := cs.New(a, b)
+		srv.UsePush(func(c *cs.Context) error {
+			if c.SID == "3" {
+				return errors.New("blocked")
+			}
+			return nil
+		})
+
+		result := srv.Broadcast(&cs.Response{Cmd: "hello"})
+		t.Assert(result.Delivered, []string{"1", "2"})
+		t.Assert(len(result.Failed), 1)
+		t.Assert(a.cmds("1"), []string{"hello"})
+		t.Assert(a.cmds("3"), []string{})
+		t.Assert(b.cmds("3"), []string{})
+
+		result = srv.BroadcastFilter(func(sid string) bool {
+			return sid == "2"
+		}, &cs.Response{Cmd: "only"})
+		t.Assert(result.Delivered, []string{"2"})
+		t.Assert(a.cmds("2"), []string{"hello", "only"})
+	})
+}
+
+func TestSrv_BroadcastRegistry(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		// 适配器的 GetAllSID 为空，广播使用会话注册表
+		server := newChanAdapter()
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.Handle("news", func(c *cs.Context) {
+			c.BroadcastAsync(&cs.Response{Cmd: "notice"})
+			c.OK()
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+		server.receive <- &cs.Request{Cmd: cs.CmdConnected}
+		time.Sleep(10 * time.Millisecond)
+
+		result := srv.Broadcast(&cs.Response{Cmd: "hello"})
+		t.Assert(result.Delivered, []string{"1"})
+		t.Assert((<-server.written).Cmd, "hello")
+
+		server.receive <- &cs.Request{Cmd: "news"}
+		cmds := []string{(<-server.written).Cmd, (<-server.written).Cmd}
+		sort.Strings(cmds)
+		t.Assert(cmds, []string{"news", "notice"})
+	})
+}
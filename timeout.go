@@ -0,0 +1,149 @@
+package cs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Timeout 处理函数超时中间件，处理函数在 d 时长内没有执行完成时，直接响应超时消息，并取消处理函数的 c.Context()
+// 超时后处理函数仍会在原 goroutine 继续执行，但是它设置的响应会被丢弃，不会再回复给客户端，之后发生的 panic 通过 OnPanic 和日志报告
+// 2 个可选参数，int 类型用于设置超时的响应码，默认为 CodeTimeout，string 类型用于设置超时的响应消息
+// Timeout(5 * time.Second)
+// Timeout(5 * time.Second, 504, "请求超时")
+// 嵌套使用时，里层的 Timeout 会覆盖外层的设置，超时时长都从请求开始计算，可用于给分组或者路由单独设置超时
+// srv.Use(cs.Timeout(time.Second))
+// srv.Handle("export", cs.Timeout(time.Minute), exportHandler)
+func Timeout(d time.Duration, args ...interface{}) HandlerFunc {
+	code := CodeTimeout
+	msg := msgTimeout
+	for _, v := range args {
+		if c, ok := v.(int); ok {
+			code = c
+		} else if m, ok := v.(string); ok {
+			msg = m
+		}
+	}
+
+	return func(c *Context) {
+		// 已经在外层的 Timeout 中，覆盖外层的设置
+		if c.timeout != nil {
+			c.timeout.set(d, code, msg)
+			c.Next()
+			return
+		}
+
+		st := &timeoutState{
+			start:   time.Now(),
+			d:       d,
+			code:    code,
+			msg:     msg,
+			changed: make(chan struct{}, 1),
+		}
+		ctx, cancel := context.WithCancel(c.Context())
+		defer cancel()
+
+		// 在副本上执行后续的处理函数，超时后处理函数对响应的修改不会影响当前上下文
+		tc := *c
+		resp := *c.Response
+		tc.Response = &resp
+		tc.ctx = ctx
+		tc.timeout = st
+
+		// 超时之后处理函数的 panic 没有人接收，直接通过 OnPanic 和日志报告
+		var lateMu sync.Mutex
+		late := false
+		reportLate := func(r timeoutResult) {
+			if _, ok := r.data.(internalPanic); r.panicked && !ok {
+				c.Srv.panicked(&tc, r.data)
+			}
+		}
+		done := make(chan timeoutResult, 1)
+		go func() {
+			panicked := true
+			defer func() {
+				if panicked {
+					r := timeoutResult{panicked: true, data: recover()}
+					lateMu.Lock()
+					if late {
+						lateMu.Unlock()
+						reportLate(r)
+						return
+					}
+					done <- r
+					lateMu.Unlock()
+				}
+			}()
+			tc.Next()
+			panicked = false
+			done <- timeoutResult{}
+		}()
+
+		for {
+			deadline, code, msg := st.get()
+			timer := time.NewTimer(time.Until(deadline))
+			select {
+			case r := <-done:
+				timer.Stop()
+				*c.Response = *tc.Response
+				c.handlerIndex = tc.handlerIndex
+				c.handlerAbort = tc.handlerAbort
+				c.panicked = tc.panicked
+				c.responded = tc.responded
+				if r.panicked {
+					panic(r.data)
+				}
+				return
+			case <-st.changed:
+				timer.Stop()
+			case <-timer.C:
+				lateMu.Lock()
+				late = true
+				lateMu.Unlock()
+				// 超时的同时处理函数 panic 了
+				select {
+				case r := <-done:
+					reportLate(r)
+				default:
+				}
+				c.Resp(code, msg, struct{}{})
+				c.Abort()
+				return
+			}
+		}
+	}
+}
+
+// 处理函数的执行结果
+type timeoutResult struct {
+	panicked bool
+	data     interface{}
+}
+
+// Timeout 中间件的超时设置，里层的 Timeout 中间件可以修改
+type timeoutState struct {
+	mu      sync.Mutex
+	start   time.Time
+	d       time.Duration
+	code    int
+	msg     string
+	changed chan struct{}
+}
+
+func (t *timeoutState) set(d time.Duration, code int, msg string) {
+	t.mu.Lock()
+	t.d = d
+	t.code = code
+	t.msg = msg
+	t.mu.Unlock()
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (t *timeoutState) get() (time.Time, int, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.start.Add(t.d), t.code, t.msg
+}
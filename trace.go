@@ -0,0 +1,240 @@
+package cs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanContext span 的标识，在消息的 trace 字段中以 "<trace id>-<span id>" 的格式传递
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// IsValid 是否包含 trace id
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != ""
+}
+
+// String 消息 trace 字段的值，无效时为空字符串
+func (sc SpanContext) String() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	if sc.SpanID == "" {
+		return sc.TraceID
+	}
+	return sc.TraceID + "-" + sc.SpanID
+}
+
+// ParseSpanContext 解析消息的 trace 字段，格式错误时返回无效的 SpanContext
+// trace id 为最多 32 位的十六进制字符串，span id 为最多 16 位的十六进制字符串，客户端传递的其他内容会被丢弃
+func ParseSpanContext(s string) SpanContext {
+	traceID, spanID := s, ""
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		traceID, spanID = s[:i], s[i+1:]
+		if !isHexID(spanID, 16) {
+			return SpanContext{}
+		}
+	}
+	if !isHexID(traceID, 32) {
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: traceID, SpanID: spanID}
+}
+
+// 是否是长度在 1 到 max 之间的十六进制字符串
+func isHexID(s string, max int) bool {
+	if s == "" || len(s) > max {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// NewSpanContext 生成新的 span 标识，parent 有效时沿用它的 trace id，否则生成新的 trace id
+// 应该在实现 Tracer 时才有用
+func NewSpanContext(parent SpanContext) SpanContext {
+	sc := SpanContext{TraceID: parent.TraceID, SpanID: randomHex(8)}
+	if !parent.IsValid() {
+		sc.TraceID = randomHex(16)
+	}
+	return sc
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Span 一次操作的跟踪
+type Span interface {
+	// Context span 的标识
+	Context() SpanContext
+	// SetAttr 设置属性，如 sid, cmd
+	SetAttr(key, value string)
+	// End 操作结束
+	End()
+}
+
+// Tracer 跟踪器，可以对接 OpenTelemetry 等跟踪系统
+// 框架在收到消息时开始 cs.receive span，处理函数、推送和广播分别是它的子 span cs.handle, cs.push, cs.broadcast
+type Tracer interface {
+	// Start 开始一个 span，parent 无效时开始新的 trace
+	Start(parent SpanContext, name string) Span
+}
+
+// SetTracer 设置跟踪器，默认不记录 span，只把请求消息的 trace 字段传递给响应和推送的消息
+func (s *Srv) SetTracer(t Tracer) *Srv {
+	if t == nil {
+		t = noopTracer{}
+	}
+	s.tracer = t
+	return s
+}
+
+// 开始 span，attrs 为属性的键值对
+func (s *Srv) startSpan(parent SpanContext, name string, attrs ...string) Span {
+	span := s.tracer.Start(parent, name)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		span.SetAttr(attrs[i], attrs[i+1])
+	}
+	return span
+}
+
+// Span 当前请求的 span
+func (c *Context) Span() Span {
+	if c.span == nil {
+		return noopSpan{}
+	}
+	return c.span
+}
+
+// StartSpan 开始当前请求的子 span，用于跟踪处理函数中的操作，结束时需调用 span.End()
+func (c *Context) StartSpan(name string) Span {
+	return c.Srv.startSpan(c.spanContext(), name)
+}
+
+// TraceID 当前请求的 trace id，没有时返回空字符串
+func (c *Context) TraceID() string {
+	return c.spanContext().TraceID
+}
+
+// 当前请求的 span 标识，c 为空时返回无效的标识
+func (c *Context) spanContext() SpanContext {
+	if c == nil || c.span == nil {
+		return SpanContext{}
+	}
+	return c.span.Context()
+}
+
+// 不记录的跟踪器，span 的标识沿用 parent
+type noopTracer struct{}
+
+func (noopTracer) Start(parent SpanContext, name string) Span {
+	return noopSpan{parent}
+}
+
+type noopSpan struct {
+	sc SpanContext
+}
+
+func (s noopSpan) Context() SpanContext    { return s.sc }
+func (noopSpan) SetAttr(key, value string) {}
+func (noopSpan) End()                      {}
+
+// TraceRecorder 在内存中记录 span 的跟踪器，用于测试
+// rec := cs.NewTraceRecorder(); srv.SetTracer(rec); rec.Spans()
+type TraceRecorder struct {
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+// RecordedSpan TraceRecorder 记录的 span
+type RecordedSpan struct {
+	Name    string
+	Context SpanContext
+	Parent  SpanContext
+	Attrs   map[string]string
+	Start   time.Time
+	End     time.Time
+}
+
+// NewTraceRecorder 创建内存跟踪器
+func NewTraceRecorder() *TraceRecorder {
+	return &TraceRecorder{}
+}
+
+// Start 实现 Tracer 接口
+func (r *TraceRecorder) Start(parent SpanContext, name string) Span {
+	return &recordingSpan{
+		recorder: r,
+		span: RecordedSpan{
+			Name:    name,
+			Context: NewSpanContext(parent),
+			Parent:  parent,
+			Attrs:   map[string]string{},
+			Start:   time.Now(),
+		},
+	}
+}
+
+// Spans 已结束的 span，按结束的顺序排列
+func (r *TraceRecorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordedSpan{}, r.spans...)
+}
+
+// Reset 清空已记录的 span
+func (r *TraceRecorder) Reset() {
+	r.mu.Lock()
+	r.spans = nil
+	r.mu.Unlock()
+}
+
+type recordingSpan struct {
+	recorder *TraceRecorder
+	mu       sync.Mutex
+	span     RecordedSpan
+	ended    bool
+}
+
+func (s *recordingSpan) Context() SpanContext {
+	return s.span.Context
+}
+
+func (s *recordingSpan) SetAttr(key, value string) {
+	s.mu.Lock()
+	s.span.Attrs[key] = value
+	s.mu.Unlock()
+}
+
+func (s *recordingSpan) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.span.End = time.Now()
+	span := s.span
+	span.Attrs = make(map[string]string, len(s.span.Attrs))
+	for k, v := range s.span.Attrs {
+		span.Attrs[k] = v
+	}
+	s.mu.Unlock()
+
+	s.recorder.mu.Lock()
+	s.recorder.spans = append(s.recorder.spans, span)
+	s.recorder.mu.Unlock()
+}
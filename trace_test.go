@@ -0,0 +1,74 @@
+package cs_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/test/gtest"
+)
+
+type bufLogger struct {
+	lines chan string
+}
+
+func (l *bufLogger) Debug(v ...interface{}) {
+	l.lines <- v[0].(string)
+}
+
+func TestSrv_Trace(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		rec := cs.NewTraceRecorder()
+		logger := &bufLogger{lines: make(chan string, 10)}
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetTracer(rec)
+		srv.Use(srv.AccessLogger(logger))
+		srv.Handle("fan", func(c *cs.Context) {
+			c.PushSID("1", &cs.Response{Cmd: "notice"})
+			c.Broadcast(&cs.Response{Cmd: "news"})
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "fan", Trace: "a1-b1"}
+		for i := 0; i < 3; i++ {
+			resp := <-server.written
+			t.Assert(strings.HasPrefix(resp.Trace, "a1-"), true)
+		}
+		for i := 0; i < 4; i++ {
+			t.Assert(strings.Contains(<-logger.lines, " TRACE=a1 "), true)
+		}
+
+		time.Sleep(10 * time.Millisecond) // 响应写入后 cs.receive 才结束
+		spans := map[string]cs.RecordedSpan{}
+		for _, span := range rec.Spans() {
+			t.Assert(span.Context.TraceID, "a1")
+			if span.Name == "cs.push" && span.Attrs["cmd"] == "news" {
+				span.Name = "cs.push.news"
+			}
+			spans[span.Name] = span
+		}
+		t.Assert(spans["cs.receive"].Parent, cs.SpanContext{TraceID: "a1", SpanID: "b1"})
+		t.Assert(spans["cs.handle"].Parent, spans["cs.receive"].Context)
+		t.Assert(spans["cs.handle"].Attrs["cmd"], "fan")
+		t.Assert(spans["cs.push"].Parent, spans["cs.handle"].Context)
+		t.Assert(spans["cs.broadcast"].Parent, spans["cs.handle"].Context)
+		t.Assert(spans["cs.push.news"].Parent, spans["cs.broadcast"].Context)
+	})
+}
+
+func TestParseSpanContext(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		t.Assert(cs.ParseSpanContext("4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"), cs.SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"})
+		t.Assert(cs.ParseSpanContext("A1"), cs.SpanContext{TraceID: "A1"})
+		// 不是十六进制或者过长的值被丢弃
+		for _, s := range []string{"", "t1-s1", "a1-", "-b1", "a1-b1-c1", "a1<script>", strings.Repeat("a", 33), "a1-" + strings.Repeat("b", 17)} {
+			t.Assert(cs.ParseSpanContext(s).IsValid(), false)
+		}
+	})
+}
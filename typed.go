@@ -0,0 +1,78 @@
+package cs
+
+import (
+	"errors"
+	"reflect"
+)
+
+// CodedError 携带响应码的错误，处理函数返回该类错误时，使用错误的响应码响应
+type CodedError interface {
+	error
+	ErrCode() int
+}
+
+// Typed 使用请求和响应的结构体定义处理函数
+// 请求数据会使用 Context.Parse 的规则解析和验证到 req，解析失败时响应 CodeBadRequest
+// 处理函数返回错误时，如果错误实现了 CodedError 则使用其响应码，否则响应 CodeError，错误消息为 err.Error()
+// 错误链中有 *cs.Error 时使用它的响应码、消息和数据，见 Context.Err
+// 处理函数没有返回错误时，响应 resp 作为 data，resp 为 nil 时 data 为空对象
+// 需要通过 Srv.Routes 查看请求和响应的类型时，使用 NewTypedRoute 和 HandleTyped 注册
+//
+//	srv.Handle("user.get", cs.Typed(func(c *cs.Context, req *GetUserReq) (*User, error) {
+//		return findUser(c.Context(), req.UID)
+//	}))
+func Typed[Req, Resp any](fn func(c *Context, req *Req) (*Resp, error)) HandlerFunc {
+	return func(c *Context) {
+		req := new(Req)
+		if err := c.Parse(req); err != nil {
+			c.Err(err, ErrCode(err, CodeBadRequest))
+			return
+		}
+		resp, err := fn(c, req)
+		if err != nil {
+			c.Err(err, ErrCode(err, CodeError))
+			return
+		}
+		if resp == nil {
+			c.OK()
+			return
+		}
+		c.OK(resp)
+	}
+}
+
+// TypedRoute 使用 Typed 创建的处理函数和它的请求、响应类型，通过 HandleTyped 注册
+type TypedRoute struct {
+	handler HandlerFunc
+	typed   *typedInfo
+}
+
+// NewTypedRoute 创建 TypedRoute，处理函数的规则同 Typed
+//
+//	srv.HandleTyped("user.get", cs.NewTypedRoute(func(c *cs.Context, req *GetUserReq) (*User, error) {
+//		return findUser(c.Context(), req.UID)
+//	}))
+func NewTypedRoute[Req, Resp any](fn func(c *Context, req *Req) (*Resp, error)) TypedRoute {
+	return TypedRoute{
+		handler: Typed(fn),
+		typed: &typedInfo{
+			request:  reflect.TypeOf((*Req)(nil)).Elem(),
+			response: reflect.TypeOf((*Resp)(nil)).Elem(),
+		},
+	}
+}
+
+// ErrCode 获取错误的响应码，如果错误链中有 CodedError 并且响应码不为 0 则返回其响应码，否则返回 defaultCode
+func ErrCode(err error, defaultCode int) int {
+	var ce CodedError
+	if errors.As(err, &ce) && ce.ErrCode() != 0 {
+		return ce.ErrCode()
+	}
+	return defaultCode
+}
+
+// 使用 HandleTyped 注册的路由的类型信息
+type typedInfo struct {
+	request  reflect.Type
+	response reflect.Type
+}
@@ -1,6 +1,7 @@
 package cs
 
 import (
+	"context"
 	"encoding/json"
 )
 
@@ -18,16 +19,38 @@ const (
 const (
 	msgOk           = "ok"
 	msgUnsupportCmd = "unsupport cmd"
+	msgServerClosed = "server closed"
+	msgTimeout      = "handler timeout"
+	msgBusy         = "server busy"
+	msgRateLimit    = "too many requests"
+	msgUnauthorized = "unauthorized"
+	msgValidation   = "validation failed"
+)
+
+// 内置响应码
+const (
+	CodeUnsupportCmd = -1 // 没有匹配到路由或者服务已关闭
+	CodePanic        = -2 // 处理函数发生 panic，由 Recover 中间件响应
+	CodeTimeout      = -3 // 处理函数执行超时，由 Timeout 中间件响应
+	CodeBadRequest   = -4 // 请求数据解析或验证失败
+	CodeError        = -5 // 处理函数返回了没有指定响应码的错误
+	CodeBusy         = -6 // 消息队列已满，消息被丢弃
+	CodeRateLimit    = -7 // 请求太频繁，由 RateLimit 中间件响应
+	CodeUnauthorized = -8 // 会话没有通过认证
+	CodeValidation   = -9 // 请求数据验证失败，Srv.SetValidation 开启 Detail 时响应
 )
 
 // Request request message
+// construct it with keyed fields, e.g. cs.Request{Cmd: "a", Seqno: "1"}, positional literals break when fields are added
 type Request struct {
 	Cmd     string          // message command, use for route
 	Seqno   string          // seq number,the request id
 	RawData json.RawMessage // request raw []byte data
+	Trace   string          // optional trace context, "<trace id>-<span id>"
 }
 
 // Response reply Request message
+// construct it with keyed fields, positional literals break when fields are added
 type Response struct {
 	*Request             // reply the Request
 	Cmd      string      // message command, use for route
@@ -35,6 +58,7 @@ type Response struct {
 	Code     int         // response status code
 	Msg      string      // response status message text
 	Data     interface{} // response data
+	Trace    string      // optional trace context, "<trace id>-<span id>"
 }
 
 func (r *Response) fill() {
@@ -58,3 +82,15 @@ type ServerAdapter interface {
 	// GetAllSID get server all sid
 	GetAllSID() []string
 }
+
+// ShutdownAdapter 可选接口，适配器实现该接口后，在 Srv.Shutdown 时会被调用
+// 适配器应在此时停止接收新的连接（如关闭监听），并在 Shutdown 返回后让 Read 读完已缓冲的消息后返回错误
+type ShutdownAdapter interface {
+	Shutdown(ctx context.Context) error
+}
+
+// RemoteAddrAdapter 可选接口，适配器实现该接口后可以获取会话的远程地址，如按 IP 限流时使用
+type RemoteAddrAdapter interface {
+	// RemoteAddr 会话的远程地址，如 127.0.0.1:8080，会话不存在时返回空字符串
+	RemoteAddr(sid string) string
+}
@@ -0,0 +1,107 @@
+package cs
+
+import "errors"
+
+// BindUser 将会话 sid 绑定到用户 uid，一个用户可以同时绑定多个会话，如网页端和手机端
+// 一个会话只能绑定一个用户，重复绑定时会替换之前的用户，会话关闭后自动解除绑定
+func (s *Srv) BindUser(sid, uid string) {
+	s.users.set(uid, sid)
+}
+
+// UnbindUser 解除会话 sid 与用户的绑定
+func (s *Srv) UnbindUser(sid string) {
+	s.users.removeSid(sid)
+}
+
+// UserID 获取会话 sid 绑定的用户，没有绑定时返回空字符串
+func (s *Srv) UserID(sid string) string {
+	if uids := s.users.keysOf(sid); len(uids) > 0 {
+		return uids[0]
+	}
+	return ""
+}
+
+// UserSIDs 获取用户 uid 绑定的所有会话 SID
+func (s *Srv) UserSIDs(uid string) []string {
+	return s.users.sidsOf(uid)
+}
+
+// PushUser 往用户 uid 绑定的所有会话推送消息，消息会经过推送中间件
+// 用户没有绑定会话时返回错误，推送失败时返回第一个错误，其他会话仍会推送
+func (s *Srv) PushUser(uid string, resp *Response) error {
+	return s.pushUser(nil, uid, resp)
+}
+
+// CloseUser 关闭用户 uid 绑定的所有会话
+func (s *Srv) CloseUser(uid string) error {
+	var firstErr error
+	for _, sid := range s.UserSIDs(uid) {
+		if err := s.Close(sid); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// 往用户绑定的所有会话推送消息
+func (s *Srv) pushUser(c *Context, uid string, resp *Response) error {
+	sids := s.UserSIDs(uid)
+	if len(sids) == 0 {
+		return errors.New("the user is offline")
+	}
+	var firstErr error
+	for _, sid := range sids {
+		if err := s.pushSID(c, sid, resp); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// 经过推送中间件往会话 sid 推送消息，c 为空时以接收者的会话执行推送中间件
+func (s *Srv) pushSID(c *Context, sid string, resp *Response) error {
+	server, err := s.getSidServer(sid)
+	if err != nil {
+		return err
+	}
+	return s.pushServer(c, c.spanContext(), server, sid, resp)
+}
+
+// 经过推送中间件往指定适配器的会话 sid 推送消息，推送的 span 是 parent 的子 span
+func (s *Srv) pushServer(c *Context, parent SpanContext, server ServerAdapter, sid string, resp *Response) error {
+	if c == nil {
+		c = s.pushContext(server, sid)
+	}
+	span := s.startSpan(parent, "cs.push", "sid", sid, "cmd", resp.Cmd)
+	defer span.End()
+	pc := *c
+	pc.span = span
+	ctx, err := s.callPushMiddleware(&pc, resp)
+	if err == nil {
+		err = s.PushServer(server, sid, ctx.Response)
+	}
+	if err != nil {
+		span.SetAttr("error", err.Error())
+	}
+	return err
+}
+
+// BindUser 将当前会话绑定到用户 uid
+func (c *Context) BindUser(uid string) {
+	c.Srv.BindUser(c.SID, uid)
+}
+
+// UnbindUser 解除当前会话与用户的绑定
+func (c *Context) UnbindUser() {
+	c.Srv.UnbindUser(c.SID)
+}
+
+// UserID 获取当前会话绑定的用户，没有绑定时返回空字符串
+func (c *Context) UserID() string {
+	return c.Srv.UserID(c.SID)
+}
+
+// PushUser 往用户 uid 绑定的所有会话推送消息
+func (c *Context) PushUser(uid string, resp *Response) error {
+	return c.Srv.pushUser(c, uid, resp)
+}
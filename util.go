@@ -6,6 +6,15 @@ import (
 	"runtime"
 )
 
+// 获取调用方的源码位置，skip 同 runtime.Caller
+func callerSource(skip int) (string, int) {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "", 0
+	}
+	return file, line
+}
+
 func funcName(f interface{}) string {
 	return runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
 }
@@ -19,3 +28,12 @@ func randomString(n int) string {
 	}
 	return string(b)
 }
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
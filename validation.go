@@ -0,0 +1,111 @@
+package cs
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/gogf/gf/i18n/gi18n"
+	"github.com/gogf/gf/util/gvalid"
+)
+
+// ValidationConfig Context.Parse 的验证配置
+type ValidationConfig struct {
+	// Detail 验证失败时 Parse 返回 *cs.Error，响应码为 Code，消息为第一个错误，数据为所有字段的错误 []cs.FieldError
+	// 默认为 false，Parse 返回 gvalid 的错误，响应消息为第一个错误
+	Detail bool
+	Code   int                        // Detail 为 true 时验证失败的响应码，默认为 CodeValidation
+	Rules  map[string]gvalid.RuleFunc // 自定义验证规则，规则名 => 验证函数，可以在结构体的 v 标签中使用
+	I18n   *gi18n.Manager             // 错误消息的翻译，默认使用 gi18n.Instance()，规则的消息使用 gf.gvalid.rule.<规则名> 作为 key
+	// Language 会话使用的语言，如 zh-CN，为空或者返回空字符串时使用 I18n 的默认语言
+	Language func(c *Context) string
+}
+
+// FieldError 字段验证失败的信息
+type FieldError struct {
+	Field string `json:"field"` // 字段名，优先使用 v 标签或者 p 标签的别名，[]struct 时为 "<下标>.<字段名>"
+	Rule  string `json:"rule"`  // 验证失败的规则，如 required
+	Msg   string `json:"msg"`   // 错误消息
+}
+
+// SetValidation 设置 Context.Parse 的验证配置
+// srv.SetValidation(cs.ValidationConfig{Detail: true, Rules: map[string]gvalid.RuleFunc{"phone": checkPhone}})
+func (s *Srv) SetValidation(conf ValidationConfig) *Srv {
+	if conf.Code == 0 {
+		conf.Code = CodeValidation
+	}
+	v := gvalid.New().RuleFuncMap(conf.Rules)
+	if conf.I18n != nil {
+		v = v.I18n(conf.I18n)
+	}
+	s.validation = &validation{conf: conf, validator: v}
+	return s
+}
+
+type validation struct {
+	conf      ValidationConfig
+	validator *gvalid.Validator // 只读，每次验证时通过 Ctx 复制
+}
+
+// 验证结构体，field 为 []struct 的下标前缀
+func (c *Context) validate(pointer interface{}, prefix string) error {
+	v := c.Srv.validation
+	if v == nil {
+		if err := gvalid.CheckStruct(c.Context(), pointer, nil); err != nil {
+			return err
+		}
+		return nil
+	}
+	ctx := c.Context()
+	if v.conf.Language != nil {
+		if lang := v.conf.Language(c); lang != "" {
+			ctx = gi18n.WithLanguage(ctx, lang)
+		}
+	}
+	verr := v.validator.Ctx(ctx).CheckStruct(pointer)
+	if verr == nil {
+		return nil
+	}
+	if !v.conf.Detail {
+		return verr
+	}
+	return &Error{
+		Code: v.conf.Code,
+		Msg:  verr.FirstString(),
+		Data: fieldErrors(verr, prefix),
+		Err:  verr,
+	}
+}
+
+// 字段的错误，字段按验证的顺序，同一个字段的规则按名称排序
+func fieldErrors(verr gvalid.Error, prefix string) []FieldError {
+	list := []FieldError{}
+	for _, item := range verr.Items() {
+		for field, rules := range item {
+			names := make([]string, 0, len(rules))
+			for rule := range rules {
+				names = append(names, rule)
+			}
+			sort.Strings(names)
+			for _, rule := range names {
+				list = append(list, FieldError{Field: prefix + field, Rule: rule, Msg: rules[rule]})
+			}
+		}
+	}
+	return list
+}
+
+// 合并 []struct 每个元素的字段错误，消息和原因使用第一个元素的错误
+func mergeValidationErrors(errs []*Error) *Error {
+	merged := *errs[0]
+	fields := []FieldError{}
+	for _, e := range errs {
+		fields = append(fields, e.Data.([]FieldError)...)
+	}
+	merged.Data = fields
+	return &merged
+}
+
+// []struct 元素的字段前缀
+func indexPrefix(i int) string {
+	return strconv.Itoa(i) + "."
+}
@@ -0,0 +1,104 @@
+package cs_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eyasliu/cs"
+	"github.com/gogf/gf/i18n/gi18n"
+	"github.com/gogf/gf/test/gtest"
+	"github.com/gogf/gf/util/gvalid"
+)
+
+type validationReq struct {
+	Name  string `v:"name@required"`
+	Phone string `v:"phone@required|phone-cn"`
+}
+
+func checkPhoneCN(ctx context.Context, rule string, value interface{}, message string, data interface{}) error {
+	if s, _ := value.(string); len(s) != 11 {
+		return errors.New("invalid phone")
+	}
+	return nil
+}
+
+func TestSrv_Validation(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		dir, err := os.MkdirTemp("", "cs-i18n")
+		t.Assert(err, nil)
+		defer os.RemoveAll(dir)
+		t.Assert(os.MkdirAll(filepath.Join(dir, "zh-CN"), 0755), nil)
+		toml := `"gf.gvalid.rule.required" = ":attribute 不能为空"` + "\n"
+		t.Assert(os.WriteFile(filepath.Join(dir, "zh-CN", "validation.toml"), []byte(toml), 0644), nil)
+
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.SetValidation(cs.ValidationConfig{
+			Detail: true,
+			Rules:  map[string]gvalid.RuleFunc{"phone-cn": checkPhoneCN},
+			I18n:   gi18n.New(gi18n.Options{Path: dir}),
+			Language: func(c *cs.Context) string {
+				lang, _ := c.Get("lang").(string)
+				return lang
+			},
+		})
+		srv.Handle("one", cs.Typed(func(c *cs.Context, req *validationReq) (*struct{}, error) {
+			return nil, nil
+		}))
+		srv.Handle("many", func(c *cs.Context) {
+			var req []validationReq
+			c.Err(c.Parse(&req), cs.CodeBadRequest)
+		})
+		srv.Handle("lang", func(c *cs.Context) {
+			c.Set("lang", "zh-CN")
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "one", RawData: []byte(`{"phone":"123"}`)}
+		resp := <-server.written
+		t.Assert(resp.Code, cs.CodeValidation)
+		t.Assert(resp.Msg, "The name field is required")
+		t.Assert(resp.Data, []cs.FieldError{
+			{Field: "name", Rule: "required", Msg: "The name field is required"},
+			{Field: "phone", Rule: "phone-cn", Msg: "invalid phone"},
+		})
+
+		server.receive <- &cs.Request{Cmd: "many", RawData: []byte(`[{"name":"a","phone":"12345678901"},{"phone":"12345678901"}]`)}
+		resp = <-server.written
+		t.Assert(resp.Code, cs.CodeValidation)
+		t.Assert(resp.Data, []cs.FieldError{{Field: "1.name", Rule: "required", Msg: "The name field is required"}})
+
+		server.receive <- &cs.Request{Cmd: "lang"}
+		<-server.written
+		server.receive <- &cs.Request{Cmd: "one", RawData: []byte(`{"phone":"12345678901"}`)}
+		resp = <-server.written
+		t.Assert(resp.Msg, "name 不能为空")
+	})
+}
+
+func TestContext_ParseWithoutDetail(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		server := newChanAdapter("1")
+		server.written = make(chan *cs.Response, 10)
+		srv := cs.New(server)
+		srv.SetDebugOutput(nil)
+		srv.Handle("one", cs.Typed(func(c *cs.Context, req *struct {
+			Name string `v:"name@required"`
+		}) (*struct{}, error) {
+			return nil, nil
+		}))
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		server.receive <- &cs.Request{Cmd: "one", RawData: []byte(`{}`)}
+		resp := <-server.written
+		t.Assert(resp.Code, cs.CodeBadRequest)
+		t.Assert(resp.Msg, "The name field is required")
+	})
+}
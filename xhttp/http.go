@@ -1,11 +1,13 @@
 package xhttp
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,7 +16,14 @@ import (
 )
 
 // HTTP cs 的 HTTP 适配器
+// 每个 SSE 连接都有一个发送队列，队列的长度，满了之后的处理策略和写入超时通过 Queue 配置
 type HTTP struct {
+	Queue  cs.QueueConfig // SSE 连接发送队列的配置
+	Logger cs.Logger      // 日志，为空时使用 Srv 的日志
+	// IdleTimeout 没有 SSE 连接的会话，第一次命令请求时产生 CmdConnected 消息
+	// 超过该时长没有命令请求时产生 CmdClosed 消息，清理会话的状态，默认为 10 分钟
+	IdleTimeout time.Duration
+
 	srv       *cs.Srv
 	receive   chan *reqMessage
 	session   map[string][]*SSEConn // http 模式可能出现一个会话多个连接的情况
@@ -23,18 +32,32 @@ type HTTP struct {
 	sidCount  uint32
 	hbTime    time.Duration
 	msgType   SSEMsgType
+	done      chan struct{} // 适配器关闭通知
+	closeOnce sync.Once
+	idle      map[string]*idleSession // 没有 SSE 连接的会话，由 sessionMu 保护
+	idleOnce  sync.Once
 }
 
+var _ cs.ServerAdapter = &HTTP{}
+var _ cs.ShutdownAdapter = &HTTP{}
+var _ cs.RemoteAddrAdapter = &HTTP{}
+var _ cs.CredentialsAdapter = &HTTP{}
+var _ cs.QueueAdapter = &HTTP{}
+
 var defaultHeartBeatTime = 10 * time.Second
 
+var defaultIdleTimeout = 10 * time.Minute
+
 // New 实例化适配器
 func New() *HTTP {
 	h := &HTTP{
 		sidKey:  "sid",
 		session: make(map[string][]*SSEConn),
+		idle:    make(map[string]*idleSession),
 		receive: make(chan *reqMessage, 2),
 		hbTime:  defaultHeartBeatTime,
 		msgType: SSEMessage,
+		done:    make(chan struct{}),
 	}
 	return h
 }
@@ -46,6 +69,13 @@ func (h *HTTP) Handler(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte("srv not running"))
 		return
 	}
+	select {
+	case <-h.done:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("srv is shutdown"))
+		return
+	default:
+	}
 	sid := h.setSid(w, req)
 	if sid == "" {
 		w.WriteHeader(400)
@@ -87,27 +117,85 @@ func (h *HTTP) Write(sid string, resp *cs.Response) error {
 }
 
 // Read 实现 cs.ServerAdapter 接口，读取消息，每次返回一条，循环读取
+// HTTP 请求的命令在请求中直接处理，这里只会读取到会话的内置命令
 func (h *HTTP) Read(srv *cs.Srv) (sid string, req *cs.Request, err error) {
 	h.srv = srv
-	<-make(chan struct{})
-	return "", nil, errors.New("HTTP Adapter unsupport Read")
+	select {
+	case m := <-h.receive:
+		return m.sid, m.data, nil
+	case <-h.done:
+		select {
+		case m := <-h.receive:
+			return m.sid, m.data, nil
+		default:
+			return "", nil, errors.New("http server is shutdown")
+		}
+	}
 }
 
-// Close 实现 cs.ServerAdapter 接口，关闭指定连接
+// Close 实现 cs.ServerAdapter 接口，关闭指定连接，没有 SSE 连接的会话直接下线
 func (h *HTTP) Close(sid string) error {
+	h.sessionMu.Lock()
 	conns, ok := h.session[sid]
-	if !ok {
+	delete(h.session, sid)
+	_, idle := h.idle[sid]
+	delete(h.idle, sid)
+	h.sessionMu.Unlock()
+	if !ok && !idle {
 		return errors.New("ths sid already close")
 	}
 	for _, conn := range conns {
 		conn.destroy(nil)
 	}
-	h.sessionMu.Lock()
-	delete(h.session, sid)
-	h.sessionMu.Unlock()
+	h.emit(&reqMessage{data: &cs.Request{
+		Cmd: cs.CmdClosed,
+	}, sid: sid})
+	return nil
+}
+
+// Shutdown 实现 cs.ShutdownAdapter 接口，拒绝新的请求并停止产生消息
+func (h *HTTP) Shutdown(ctx context.Context) error {
+	h.closeOnce.Do(func() {
+		close(h.done)
+	})
+	return nil
+}
+
+// RemoteAddr 实现 cs.RemoteAddrAdapter 接口，获取会话的远程地址
+func (h *HTTP) RemoteAddr(sid string) string {
+	if cred := h.Credentials(sid); cred != nil {
+		return cred.RemoteAddr
+	}
+	return ""
+}
+
+// Credentials 实现 cs.CredentialsAdapter 接口，返回会话的 SSE 连接的请求头和查询参数
+// 命令请求使用请求本身的认证信息，通过 cs.Context.WithCredentials 设置，不经过该方法
+func (h *HTTP) Credentials(sid string) *cs.Credentials {
+	h.sessionMu.RLock()
+	defer h.sessionMu.RUnlock()
+	if conns := h.session[sid]; len(conns) > 0 {
+		return conns[0].cred
+	}
+	if idle, ok := h.idle[sid]; ok {
+		return idle.cred
+	}
 	return nil
 }
 
+// QueueLen 实现 cs.QueueAdapter 接口，所有 SSE 连接的发送队列中等待写入的消息数量
+func (h *HTTP) QueueLen() int {
+	n := 0
+	h.sessionMu.RLock()
+	for _, conns := range h.session {
+		for _, conn := range conns {
+			n += conn.queue.Len()
+		}
+	}
+	h.sessionMu.RUnlock()
+	return n
+}
+
 // GetAllSID 实现 cs.ServerAdapter 接口，获取当前服务所有SID，用于遍历连接
 func (h *HTTP) GetAllSID() []string {
 	sids := make([]string, 0, len(h.session))
@@ -143,45 +231,82 @@ func (h *HTTP) setSid(w http.ResponseWriter, req *http.Request) string {
 
 // 处理cmd路由
 func (h *HTTP) invokeHandle(sid string, w http.ResponseWriter, req *http.Request) {
-	reqData := &requestData{}
+	codec, contentType := codecFromContentType(req.Header.Get("Content-Type"))
+	reqData := &cs.Request{}
 	respData := &cs.Response{}
 	data, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		respData.Msg = err.Error()
 	} else {
-		err := json.Unmarshal(data, reqData)
+		err := codec.Unmarshal(data, reqData)
 		if err != nil {
+			h.logger().Log(cs.LevelWarn, "decode message failed", "sid", sid, "codec", codec.Name(), "error", err)
 			respData.Msg = err.Error()
 		}
-		ctx := h.srv.NewContext(h, sid, &cs.Request{
-			Cmd:     reqData.Cmd,
-			Seqno:   reqData.Seqno,
-			RawData: reqData.Data,
-		})
+		cred := requestCredentials(req)
+		h.touch(sid, cred)
+		ctx := h.srv.NewContext(h, sid, reqData).WithCredentials(cred)
 		h.srv.CallContext(ctx)
+		h.refresh(sid)
 		respData = ctx.Response
 	}
 
-	resp := &responseData{
-		Cmd:   respData.Cmd,
-		Seqno: respData.Seqno,
-		Code:  respData.Code,
-		Msg:   respData.Msg,
-		Data:  respData.Data,
-	}
-	respBt, _ := json.Marshal(resp)
+	respBt, _ := codec.Marshal(respData)
 
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(200)
-	w.Header().Set("Content-Type", "application/json")
 	w.Write(respBt)
 }
 
+// 日志，没有设置 Logger 时使用 Srv 的日志
+func (h *HTTP) logger() cs.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	if h.srv != nil {
+		return h.srv.Logger()
+	}
+	return cs.NopLogger
+}
+
+// 请求的认证信息
+func requestCredentials(req *http.Request) *cs.Credentials {
+	return &cs.Credentials{
+		Header:     req.Header,
+		Query:      req.URL.Query(),
+		RemoteAddr: req.RemoteAddr,
+	}
+}
+
+// 根据请求的 Content-Type 选择编解码器，支持 application/json, application/msgpack, application/cbor 等
+// 以及 application/x-{name}，{name} 为已注册的编解码器名称，无法识别时使用 JSON
+func codecFromContentType(contentType string) (cs.Codec, string) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && strings.HasPrefix(mediaType, "application/") {
+		name := strings.TrimPrefix(mediaType, "application/")
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "x-"), "vnd.")
+		if codec := cs.GetCodec(name); codec != nil {
+			return codec, mediaType
+		}
+	}
+	return cs.JSONCodec, "application/json"
+}
+
 // 处理 sse 连接
 func (h *HTTP) invokeSSE(sid string, w http.ResponseWriter, req *http.Request) {
-	conn, err := newSSEConn(w, h.msgType, h.hbTime)
+	conn, err := newSSEConn(w, h.msgType, h.hbTime, h.Queue, func(resp *cs.Response, err error) {
+		if h.srv != nil {
+			h.srv.WriteError(sid, resp, err)
+		}
+	})
 	if err != nil {
+		h.logger().Log(cs.LevelWarn, "sse connect failed", "sid", sid, "error", err)
+		if conn != nil {
+			conn.queue.Close()
+		}
 		return
 	}
+	conn.cred = requestCredentials(req)
 	h.sessionMu.Lock()
 
 	conns, ok := h.session[sid]
@@ -191,12 +316,24 @@ func (h *HTTP) invokeSSE(sid string, w http.ResponseWriter, req *http.Request) {
 		conns = append(conns, conn)
 	}
 	h.session[sid] = conns
+	// SSE 连接断开时会产生 CmdClosed，不再需要过期
+	_, idle := h.idle[sid]
+	delete(h.idle, sid)
 	h.sessionMu.Unlock()
+	// 会话的第一个 SSE 连接建立时会话上线，命令请求已经让会话上线时不再重复产生
+	if !ok && !idle {
+		h.emit(&reqMessage{data: &cs.Request{
+			Cmd: cs.CmdConnected,
+		}, sid: sid})
+	}
 	<-conn.notifyErr
+	// 请求结束后不能再写入，先等待发送队列写完
+	conn.queue.Close()
 
 	h.sessionMu.Lock()
 	conns, ok = h.session[sid]
 	if !ok {
+		h.sessionMu.Unlock()
 		return
 	}
 	nextConns := make([]*SSEConn, 0, len(conns)-1)
@@ -211,4 +348,89 @@ func (h *HTTP) invokeSSE(sid string, w http.ResponseWriter, req *http.Request) {
 		delete(h.session, sid)
 	}
 	h.sessionMu.Unlock()
+	// 会话的所有 SSE 连接都断开时会话下线
+	if len(nextConns) == 0 {
+		h.emit(&reqMessage{data: &cs.Request{
+			Cmd: cs.CmdClosed,
+		}, sid: sid})
+	}
+}
+
+// 投递消息给 Read，适配器关闭后丢弃消息
+func (h *HTTP) emit(m *reqMessage) {
+	select {
+	case h.receive <- m:
+	case <-h.done:
+	}
+}
+
+// 没有 SSE 连接的会话
+type idleSession struct {
+	last time.Time       // 最后一次命令请求的时间
+	cred *cs.Credentials // 第一次命令请求的认证信息，用于 CmdConnected 的认证
+}
+
+// 记录没有 SSE 连接的会话的命令请求时间，第一次调用时启动过期检查
+// 会话第一次命令请求时上线，和 SSE 连接一样产生 CmdConnected，过期时产生对应的 CmdClosed
+func (h *HTTP) touch(sid string, cred *cs.Credentials) {
+	h.idleOnce.Do(func() {
+		go h.expireIdle()
+	})
+	h.sessionMu.Lock()
+	connected := false
+	if _, ok := h.session[sid]; !ok {
+		if idle, ok := h.idle[sid]; ok {
+			idle.last = time.Now()
+		} else {
+			h.idle[sid] = &idleSession{last: time.Now(), cred: cred}
+			connected = true
+		}
+	}
+	h.sessionMu.Unlock()
+	if connected {
+		h.emit(&reqMessage{data: &cs.Request{
+			Cmd: cs.CmdConnected,
+		}, sid: sid})
+	}
+}
+
+// 命令请求处理完成后更新时间，会话在处理过程中被关闭时不再记录
+func (h *HTTP) refresh(sid string) {
+	h.sessionMu.Lock()
+	if idle, ok := h.idle[sid]; ok {
+		idle.last = time.Now()
+	}
+	h.sessionMu.Unlock()
+}
+
+// 定时让超过 IdleTimeout 没有命令请求的会话下线，适配器关闭时退出
+func (h *HTTP) expireIdle() {
+	timeout := h.IdleTimeout
+	if timeout <= 0 {
+		timeout = defaultIdleTimeout
+	}
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.done:
+			return
+		}
+		expired := []string{}
+		now := time.Now()
+		h.sessionMu.Lock()
+		for sid, idle := range h.idle {
+			if now.Sub(idle.last) >= timeout {
+				delete(h.idle, sid)
+				expired = append(expired, sid)
+			}
+		}
+		h.sessionMu.Unlock()
+		for _, sid := range expired {
+			h.emit(&reqMessage{data: &cs.Request{
+				Cmd: cs.CmdClosed,
+			}, sid: sid})
+		}
+	}
 }
@@ -4,10 +4,17 @@ package xhttp_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
@@ -74,3 +81,117 @@ func TestHttpSrv(t *testing.T) {
 	})
 
 }
+
+func TestHttpSrv_PostOnlySession(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		h := xhttp.New()
+		h.IdleTimeout = 50 * time.Millisecond
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+		srv := h.Srv()
+		srv.SetDebugOutput(nil)
+		connected := make(chan string, 2)
+		srv.Handle(cs.CmdConnected, func(c *cs.Context) {
+			connected <- c.SID
+		})
+		closed := make(chan string, 1)
+		srv.OnClose(func(sid string, reason cs.CloseReason) {
+			closed <- sid
+		})
+		srv.Handle("addr", func(c *cs.Context) {
+			time.Sleep(20 * time.Millisecond)
+			c.OK(c.RemoteAddr())
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+		post := func() map[string]interface{} {
+			resp, err := client.Post(ts.URL, "application/json", bytes.NewReader([]byte(`{"cmd":"addr"}`)))
+			t.Assert(err, nil)
+			defer resp.Body.Close()
+			res := map[string]interface{}{}
+			json.NewDecoder(resp.Body).Decode(&res)
+			return res
+		}
+		// 第一个请求设置 sid 的 cookie
+		post()
+
+		// 同一个会话并发的请求使用各自的认证信息
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.AssertNE(post()["data"], "")
+			}()
+		}
+		wg.Wait()
+
+		// 第一个命令请求时会话上线，超时后下线
+		var sid string
+		select {
+		case sid = <-connected:
+			t.AssertNE(sid, "")
+		case <-time.After(time.Second):
+			t.Error("post only session not connected")
+		}
+		select {
+		case id := <-closed:
+			t.Assert(id, sid)
+		case <-time.After(time.Second):
+			t.Error("post only session not expired")
+		}
+		t.Assert(len(connected), 0)
+	})
+}
+
+func TestHttpSrv_JWTPerRequest(t *testing.T) {
+	secret := []byte("secret")
+	sign := func(sub string, exp time.Time) string {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+		payload, _ := json.Marshal(map[string]interface{}{"sub": sub, "exp": exp.Unix()})
+		signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	gtest.C(t, func(t *gtest.T) {
+		h := xhttp.New()
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+		srv := h.Srv()
+		srv.SetDebugOutput(nil)
+		srv.Use(cs.JWTAuth(cs.JWTConfig{Key: cs.JWTKey(secret)}))
+		srv.Handle("whoami", func(c *cs.Context) {
+			c.OK(c.JWTClaims().Subject())
+		})
+		go srv.Run()
+		defer srv.Shutdown(context.Background())
+
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+		post := func(token string) map[string]interface{} {
+			req, _ := http.NewRequest("POST", ts.URL, bytes.NewReader([]byte(`{"cmd":"whoami"}`)))
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := client.Do(req)
+			t.Assert(err, nil)
+			defer resp.Body.Close()
+			res := map[string]interface{}{}
+			json.NewDecoder(resp.Body).Decode(&res)
+			return res
+		}
+
+		res := post(sign("u1", time.Now().Add(time.Hour)))
+		t.Assert(res["code"], 0)
+		t.Assert(res["data"], "u1")
+
+		// 同一个会话的每个请求都使用请求自带的 JWT
+		res = post(sign("u1", time.Now().Add(-time.Minute)))
+		t.Assert(res["code"], cs.CodeUnauthorized)
+		res = post(sign("u2", time.Now().Add(time.Hour)))
+		t.Assert(res["code"], 0)
+		t.Assert(res["data"], "u2")
+	})
+}
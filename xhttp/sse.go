@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/eyasliu/cs"
@@ -26,21 +27,28 @@ type SSEConn struct {
 	hbTime    time.Duration
 	isClose   bool
 	notifyErr chan error
+	closeOnce sync.Once
+	writeMu   sync.Mutex
+	queue     *cs.OutboundQueue
+	cred      *cs.Credentials // 连接请求的认证信息
 }
 
-func newSSEConn(w http.ResponseWriter, msgType SSEMsgType, heartbeatTime time.Duration) (*SSEConn, error) {
+func newSSEConn(w http.ResponseWriter, msgType SSEMsgType, heartbeatTime time.Duration, queue cs.QueueConfig, report func(*cs.Response, error)) (*SSEConn, error) {
+	// 先检查是否支持 Flush，再启动发送队列，避免返回错误时队列没有关闭
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("Streaming unsupported")
+	}
 	s := &SSEConn{
 		w:         w,
+		flusher:   flusher,
 		msgType:   msgType,
 		hbTime:    heartbeatTime,
-		notifyErr: make(chan error),
-	}
-	flusher, ok := s.w.(http.Flusher)
-
-	if !ok {
-		return nil, errors.New("Streaming unsupported")
+		notifyErr: make(chan error, 1),
 	}
-	s.flusher = flusher
+	s.queue = cs.NewOutboundQueue(queue, s.write, report, func() {
+		s.destroy(errors.New("slow consumer"))
+	})
 	err := s.init()
 	return s, err
 }
@@ -66,66 +74,80 @@ func (s *SSEConn) init() error {
 			if s.isClose {
 				break
 			}
+			s.writeMu.Lock()
 			_, err := fmt.Fprint(s.w, ": heartbeat\n\n")
+			if err == nil {
+				s.flusher.Flush()
+			}
+			s.writeMu.Unlock()
 			if err != nil {
 				s.destroy(err)
 				break
 			}
-			s.flusher.Flush()
 		}
 	}(s)
 	return nil
 }
 
 // Send 给 sse 连接推送数据
+// 消息放入连接的发送队列后即返回，由单独的 goroutine 写入连接
 func (s *SSEConn) Send(v ...*cs.Response) error {
+	for _, resp := range v {
+		if err := s.queue.Push(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 把消息写入连接，由发送队列调用
+// http.ResponseWriter 实现了 SetWriteDeadline 时才支持写入超时
+func (s *SSEConn) write(resp *cs.Response, deadline time.Time) error {
 	if s.w == nil {
 		err := errors.New("connection is already closed")
 		s.destroy(err)
 		return err
 	}
-	for _, resp := range v {
-		msg := ""
-		if s.msgType == SSEEvent {
-			if resp.Seqno != "" {
-				msg += "id: " + resp.Seqno + "\n"
-			}
-			msg += "event: " + resp.Cmd + "\n"
-			if resp.Data != nil {
-				dataBt, err := json.Marshal(resp.Data)
-				if err != nil {
-					return err
-				}
-				msg += "data: " + string(dataBt) + "\n"
-			}
-		} else if s.msgType == SSEMessage {
-			resp1 := &responseData{
-				Cmd:   resp.Cmd,
-				Seqno: resp.Seqno,
-				Code:  resp.Code,
-				Msg:   resp.Msg,
-				Data:  resp.Data,
-			}
-			dataBt, err := json.Marshal(resp1)
+	msg := ""
+	if s.msgType == SSEEvent {
+		if resp.Seqno != "" {
+			msg += "id: " + resp.Seqno + "\n"
+		}
+		msg += "event: " + resp.Cmd + "\n"
+		if resp.Data != nil {
+			dataBt, err := json.Marshal(resp.Data)
 			if err != nil {
 				return err
 			}
 			msg += "data: " + string(dataBt) + "\n"
-		} else {
-			return errors.New("unsupport sse message type")
 		}
-		msg += "\n\n"
-		_, err := fmt.Fprint(s.w, msg)
-		s.flusher.Flush()
+	} else if s.msgType == SSEMessage {
+		dataBt, err := cs.JSONCodec.Marshal(resp)
 		if err != nil {
-			s.destroy(err)
 			return err
 		}
+		msg += "data: " + string(dataBt) + "\n"
+	} else {
+		return errors.New("unsupport sse message type")
+	}
+	msg += "\n\n"
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if d, ok := s.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		d.SetWriteDeadline(deadline)
+	}
+	_, err := fmt.Fprint(s.w, msg)
+	s.flusher.Flush()
+	if err != nil {
+		s.destroy(err)
+		return err
 	}
 	return nil
 }
 
 func (s *SSEConn) destroy(err error) {
-	s.notifyErr <- err
-	s.isClose = true
+	s.closeOnce.Do(func() {
+		s.isClose = true
+		s.notifyErr <- err
+	})
 }
@@ -1,7 +1,6 @@
 package xhttp
 
 import (
-	"encoding/json"
 	"time"
 
 	"github.com/eyasliu/cs"
@@ -18,17 +17,3 @@ type reqMessage struct {
 	sid  string
 	data *cs.Request
 }
-
-type responseData struct {
-	Cmd   string      `json:"cmd"`   // message command, use for route
-	Seqno string      `json:"seqno"` // seq number,the request id
-	Code  int         `json:"code"`  // response status code
-	Msg   string      `json:"msg"`   // response status message text
-	Data  interface{} `json:"data"`  // response data
-}
-
-type requestData struct {
-	Cmd   string          `json:"cmd"`   // message command, use for route
-	Seqno string          `json:"seqno"` // seq number,the request id
-	Data  json.RawMessage `json:"data"`  // response data
-}
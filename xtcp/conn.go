@@ -1,9 +1,9 @@
 package xtcp
 
 import (
-	"encoding/json"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/eyasliu/cs"
 )
@@ -14,34 +14,66 @@ type Conn struct {
 	sid     string
 	server  *TCP
 	writeMu sync.Mutex
+	codecMu sync.Mutex // 保护 codec，和 writeMu 分开，写入慢时不阻塞读取
+	codec   cs.Codec
+	queue   *cs.OutboundQueue
+	authPkg []byte // Config.AuthPacket 开启时连接的第一个数据包
 }
 
 // Send 往连接推送消息，线程安全
+// 消息放入连接的发送队列后即返回，由单独的 goroutine 写入连接
 func (c *Conn) Send(v ...*cs.Response) error {
-	if len(v) == 0 {
-		return nil
-	}
-	c.writeMu.Lock()
-	defer c.writeMu.Unlock()
 	for _, msg := range v {
-		j := &responseData{
-			Cmd:   msg.Cmd,
-			Seqno: msg.Seqno,
-			Code:  msg.Code,
-			Msg:   msg.Msg,
-			Data:  msg.Data,
-		}
-		bt, err := json.Marshal(j)
-		if err != nil {
-			return err
-		}
-		pkg, err := c.server.Config.Packer(bt)
-		if err != nil {
-			return err
-		}
-		if _, err := c.Conn.Write(pkg); err != nil {
+		if err := c.queue.Push(msg); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// 把消息写入连接，由发送队列调用
+func (c *Conn) write(msg *cs.Response, deadline time.Time) error {
+	bt, err := c.getCodec().Marshal(msg)
+	if err != nil {
+		return err
+	}
+	pkg, err := c.server.Config.Packer(bt)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.Conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	_, err = c.Conn.Write(pkg)
+	return err
+}
+
+// 连接使用的消息编解码器
+func (c *Conn) getCodec() cs.Codec {
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+	return c.codecLocked()
+}
+
+// 连接使用的消息编解码器，调用方需持有 codecMu
+func (c *Conn) codecLocked() cs.Codec {
+	if c.codec != nil {
+		return c.codec
+	}
+	if c.server.Config.Codec != nil {
+		return c.server.Config.Codec
+	}
+	return cs.JSONCodec
+}
+
+// 根据收到的消息确定连接的编解码器，返回用于解码该消息的编解码器
+func (c *Conn) detectCodec(payload []byte) cs.Codec {
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+	if c.codec == nil && c.server.Config.Codec == nil {
+		c.codec = cs.DetectCodec(payload)
+	}
+	return c.codecLocked()
+}
@@ -1,7 +1,7 @@
 package xtcp
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -19,8 +19,17 @@ type TCP struct {
 	sessionMu sync.RWMutex
 	receive   chan *reqMessage
 	sidCount  uint32
+	done      chan struct{} // 适配器关闭通知
+	closeOnce sync.Once
+	srv       atomic.Value // *cs.Srv
 }
 
+var _ cs.ServerAdapter = &TCP{}
+var _ cs.ShutdownAdapter = &TCP{}
+var _ cs.RemoteAddrAdapter = &TCP{}
+var _ cs.CredentialsAdapter = &TCP{}
+var _ cs.QueueAdapter = &TCP{}
+
 // New 创建 TCP 适配器，必需指定地址或者配置，使用默认的私有协议解析数据包
 // 默认私有协议包结构: 4byte标识数据长度 + 任意byte 数据
 //
@@ -41,10 +50,19 @@ type TCP struct {
 // 	  Packer: func([]byte) ([]byte, error) {},
 // 	  Parser(string, []byte) ([][]byte, error),
 // })
+//
+// 指定消息编解码器，不指定时根据每个连接的第一个消息自动识别 JSON, MessagePack, CBOR
+//
+// xtcp.New(&xtcp.Config{
+// 	  Addr: "127.0.0.1:8520",
+// 	  Network: "tcp",
+// 	  Codec: cs.MsgpackCodec,
+// })
 func New(v interface{}) *TCP {
 	srv := &TCP{
 		session: map[string]*Conn{},
 		receive: make(chan *reqMessage, 50),
+		done:    make(chan struct{}),
 	}
 	var conf *Config
 
@@ -78,12 +96,20 @@ func (t *TCP) Srv() (*cs.Srv, error) {
 }
 
 // Read 实现 cs.ServerAdapter 接口，读取消息，每次返回一条，循环读取
+// 适配器关闭后，会先读完已缓冲的消息再返回错误
 func (t *TCP) Read(s *cs.Srv) (string, *cs.Request, error) {
-	m, ok := <-t.receive
-	if !ok {
-		return "", nil, errors.New("websocker server is shutdown")
+	t.srv.Store(s)
+	select {
+	case m := <-t.receive:
+		return m.sid, m.data, nil
+	case <-t.done:
+		select {
+		case m := <-t.receive:
+			return m.sid, m.data, nil
+		default:
+			return "", nil, errors.New("tcp server is shutdown")
+		}
 	}
-	return m.sid, m.data, nil
 }
 
 // Write 实现 cs.ServerAdapter 接口，给连接推送消息
@@ -100,6 +126,54 @@ func (t *TCP) Close(sid string) error {
 	return t.destroyConn(sid)
 }
 
+// Shutdown 实现 cs.ShutdownAdapter 接口，关闭监听并停止产生消息
+func (t *TCP) Shutdown(ctx context.Context) error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.done)
+		if t.listener != nil {
+			err = t.listener.Close()
+		}
+	})
+	return err
+}
+
+// RemoteAddr 实现 cs.RemoteAddrAdapter 接口，获取连接的远程地址
+func (t *TCP) RemoteAddr(sid string) string {
+	t.sessionMu.RLock()
+	conn, ok := t.session[sid]
+	t.sessionMu.RUnlock()
+	if !ok {
+		return ""
+	}
+	return conn.Conn.RemoteAddr().String()
+}
+
+// Credentials 实现 cs.CredentialsAdapter 接口，返回连接的远程地址和 Config.AuthPacket 开启时的第一个数据包
+func (t *TCP) Credentials(sid string) *cs.Credentials {
+	t.sessionMu.RLock()
+	conn, ok := t.session[sid]
+	t.sessionMu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return &cs.Credentials{
+		Payload:    conn.authPkg,
+		RemoteAddr: conn.Conn.RemoteAddr().String(),
+	}
+}
+
+// QueueLen 实现 cs.QueueAdapter 接口，所有连接的发送队列中等待写入的消息数量
+func (t *TCP) QueueLen() int {
+	n := 0
+	t.sessionMu.RLock()
+	for _, conn := range t.session {
+		n += conn.queue.Len()
+	}
+	t.sessionMu.RUnlock()
+	return n
+}
+
 // GetAllSID 实现 cs.ServerAdapter 接口，获取当前服务所有SID，用于遍历连接
 func (t *TCP) GetAllSID() []string {
 	sids := make([]string, 0, len(t.session))
@@ -134,12 +208,18 @@ func (t *TCP) accept() {
 	for {
 		conn, err := t.listener.Accept()
 		if err != nil {
+			select {
+			case <-t.done:
+				return
+			default:
+			}
+			t.logger().Log(cs.LevelWarn, "tcp accept failed", "error", err)
 			continue
 		}
 		atomic.AddUint32(&t.sidCount, 1)
 
 		sid := fmt.Sprintf("tcp.%d", t.sidCount)
-		t.newConn(sid, conn)
+		go t.newConn(sid, conn)
 	}
 }
 
@@ -147,45 +227,57 @@ func (t *TCP) accept() {
 func (t *TCP) newConn(sid string, netconn net.Conn) {
 	conn := &Conn{
 		Conn:   netconn,
+		sid:    sid,
 		server: t,
 	}
+	conn.queue = cs.NewOutboundQueue(t.Config.Queue, conn.write, func(resp *cs.Response, err error) {
+		t.writeError(sid, resp, err)
+	}, func() {
+		t.destroyConn(sid)
+	})
 	t.sessionMu.Lock()
 	t.session[sid] = conn
 	t.sessionMu.Unlock()
-	t.receive <- &reqMessage{
-		data: &cs.Request{
-			Cmd: cs.CmdConnected,
-		},
-		sid: sid,
+	connected := !t.Config.AuthPacket
+	if connected {
+		t.emitConnected(sid)
 	}
 	for {
 		_buf := make([]byte, 1024)
 		buflen, err := netconn.Read(_buf)
 		if err != nil {
 			// data err, close socket
+			t.logger().Log(cs.LevelDebug, "tcp read failed", "sid", sid, "error", err)
 			t.destroyConn(sid)
 			return
 		}
 		buf := _buf[:buflen]
 		payloads, err := t.Config.MsgPkg.Parser(sid, buf)
+		if err != nil {
+			t.logger().Log(cs.LevelWarn, "parse packet failed", "sid", sid, "error", err)
+		}
 
 		for _, payload := range payloads {
-
+			if !connected {
+				// 第一个数据包作为认证信息
+				conn.authPkg = payload
+				connected = true
+				t.emitConnected(sid)
+				continue
+			}
 			if len(payload) == 0 { // heartbeat
-				t.receive <- &reqMessage{data: &cs.Request{
+				t.emit(&reqMessage{data: &cs.Request{
 					Cmd: cs.CmdHeartbeat,
-				}, sid: sid}
+				}, sid: sid})
 				continue
 			}
-			r := &requestData{}
-			if err = json.Unmarshal(payload, r); err != nil {
+			req := &cs.Request{}
+			codec := conn.detectCodec(payload)
+			if err = codec.Unmarshal(payload, req); err != nil {
+				t.logger().Log(cs.LevelWarn, "decode message failed", "sid", sid, "codec", codec.Name(), "error", err)
 				continue
 			}
-			t.receive <- &reqMessage{data: &cs.Request{
-				Cmd:     r.Cmd,
-				Seqno:   r.Seqno,
-				RawData: r.Data,
-			}, sid: sid}
+			t.emit(&reqMessage{data: req, sid: sid})
 		}
 	}
 }
@@ -198,18 +290,55 @@ func (t *TCP) destroyConn(sid string) error {
 	if !ok {
 		return errors.New("conn is already close")
 	}
+	conn.queue.Close()
 	err := conn.Conn.Close()
 	if err != nil {
 		return err
 	}
-	t.receive <- &reqMessage{
+	t.emit(&reqMessage{
 		data: &cs.Request{
 			Cmd: cs.CmdClosed,
 		},
 		sid: sid,
-	}
+	})
 	t.sessionMu.Lock()
 	delete(t.session, sid)
 	t.sessionMu.Unlock()
 	return nil
 }
+
+// 投递连接建立的消息
+func (t *TCP) emitConnected(sid string) {
+	t.emit(&reqMessage{
+		data: &cs.Request{
+			Cmd: cs.CmdConnected,
+		},
+		sid: sid,
+	})
+}
+
+// 投递消息给 Read，适配器关闭后丢弃消息
+func (t *TCP) emit(m *reqMessage) {
+	select {
+	case t.receive <- m:
+	case <-t.done:
+	}
+}
+
+// 日志，没有设置 Config.Logger 时使用 Srv 的日志
+func (t *TCP) logger() cs.Logger {
+	if t.Config.Logger != nil {
+		return t.Config.Logger
+	}
+	if s, ok := t.srv.Load().(*cs.Srv); ok {
+		return s.Logger()
+	}
+	return cs.NopLogger
+}
+
+// 通知 Srv 推送消息的结果，err 为 nil 表示写入成功
+func (t *TCP) writeError(sid string, resp *cs.Response, err error) {
+	if s, ok := t.srv.Load().(*cs.Srv); ok {
+		s.WriteError(sid, resp, err)
+	}
+}
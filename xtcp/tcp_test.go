@@ -1,6 +1,7 @@
 package xtcp_test
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -74,3 +75,61 @@ func TestTcp(t *testing.T) {
 		t.Assert(res["seqno"], data["seqno"])
 	})
 }
+
+func TestTcpShutdown(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		srv, err := xtcp.New("127.0.0.1:5671").Srv()
+		t.Assert(err, nil)
+		closed := make(chan string, 1)
+		srv.Handle(cs.CmdClosed, func(c *cs.Context) {
+			closed <- c.SID
+		})
+		runErr := make(chan error, 1)
+		go func() { runErr <- srv.Run() }()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:5671")
+		t.Assert(err, nil)
+		defer conn.Close()
+		time.Sleep(50 * time.Millisecond)
+
+		t.Assert(srv.Shutdown(context.Background()), nil)
+		t.Assert(<-closed, "tcp.1")
+		t.Assert(<-runErr, cs.ErrServerClosed)
+
+		_, err = net.Dial("tcp", "127.0.0.1:5671")
+		t.AssertNE(err, nil)
+	})
+}
+
+func TestTcpCodec(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		srv, err := xtcp.New("127.0.0.1:5672").Srv()
+		t.Assert(err, nil)
+		srv.Handle("echo", func(c *cs.Context) {
+			c.OK(c.RawData)
+		})
+		go srv.Run()
+		time.Sleep(50 * time.Millisecond)
+
+		c, err := net.Dial("tcp", "127.0.0.1:5672")
+		t.Assert(err, nil)
+		defer c.Close()
+		pkg, _ := prot.Packer([]byte("\xa3\x63cmd\x64echo\x65seqno\x611\x64data\xa1\x61x\x01"))
+		_, err = c.Write(pkg)
+		t.Assert(err, nil)
+
+		buf := make([]byte, 1024)
+		n, err := c.Read(buf)
+		t.Assert(err, nil)
+		datas, err := prot.Parser("codec", buf[:n])
+		t.Assert(err, nil)
+		t.Assert(len(datas), 1)
+
+		res := &cs.Request{}
+		t.Assert(cs.DetectCodec(datas[0]), cs.CBORCodec)
+		t.Assert(cs.CBORCodec.Unmarshal(datas[0], res), nil)
+		t.Assert(res.Cmd, "echo")
+		t.Assert(res.Seqno, "1")
+		t.Assert(string(res.RawData), `{"x":1}`)
+	})
+}
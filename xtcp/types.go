@@ -1,8 +1,6 @@
 package xtcp
 
 import (
-	"encoding/json"
-
 	"github.com/eyasliu/cs"
 )
 
@@ -11,20 +9,6 @@ type reqMessage struct {
 	data *cs.Request
 }
 
-type requestData struct {
-	Cmd   string          `json:"cmd"`   // message command, use for route
-	Seqno string          `json:"seqno"` // seq number,the request id
-	Data  json.RawMessage `json:"data"`  // response data
-}
-
-type responseData struct {
-	Cmd   string      `json:"cmd"`   // message command, use for route
-	Seqno string      `json:"seqno"` // seq number,the request id
-	Code  int         `json:"code"`  // response status code
-	Msg   string      `json:"msg"`   // response status message text
-	Data  interface{} `json:"data"`  // response data
-}
-
 // MsgPkg tcp 消息的编解码，处理封包解包
 type MsgPkg interface {
 	Packer([]byte) ([]byte, error)           // tcp 数据包的封装函数，传入的数据是需要发送的业务数据，返回发送给 tcp 的数据
@@ -33,7 +17,13 @@ type MsgPkg interface {
 
 // Config 配置项
 type Config struct {
-	Addr    string // tcp 地址，在客户端使用为需要连接的地址，在服务端使用为监听的地址
-	Network string // tcp 的网络类型，可选值为 "tcp", "tcp4", "tcp6", "unix" or "unixpacket"
+	Addr    string         // tcp 地址，在客户端使用为需要连接的地址，在服务端使用为监听的地址
+	Network string         // tcp 的网络类型，可选值为 "tcp", "tcp4", "tcp6", "unix" or "unixpacket"
+	Codec   cs.Codec       // 消息编解码器，为空时根据每个连接收到的第一个消息自动识别内置的编解码器，识别前使用 JSON
+	Queue   cs.QueueConfig // 连接发送队列的配置，包括队列长度，满了之后的处理策略和写入超时
+	Logger  cs.Logger      // 日志，为空时使用 Srv 的日志
+	// AuthPacket 为 true 时连接的第一个数据包作为认证信息，不会作为命令处理
+	// 收到第一个数据包之后才产生 CmdConnected 消息，数据包通过 cs.Credentials.Payload 提供给 OnAuthenticate
+	AuthPacket bool
 	MsgPkg
 }
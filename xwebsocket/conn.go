@@ -1,8 +1,8 @@
 package xwebsocket
 
 import (
-	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/eyasliu/cs"
 	"github.com/gorilla/websocket"
@@ -13,6 +13,9 @@ type Conn struct {
 	*websocket.Conn
 	writeMu sync.Mutex
 	msgType int
+	codec   cs.Codec
+	queue   *cs.OutboundQueue
+	cred    *cs.Credentials // 升级请求的认证信息
 }
 
 type reqMessage struct {
@@ -21,44 +24,32 @@ type reqMessage struct {
 	data    *cs.Request
 }
 
-type requestData struct {
-	Cmd   string          `json:"cmd"`   // message command, use for route
-	Seqno string          `json:"seqno"` // seq number,the request id
-	Data  json.RawMessage `json:"data"`  // response data
-}
-
-type responseData struct {
-	Cmd   string      `json:"cmd"`   // message command, use for route
-	Seqno string      `json:"seqno"` // seq number,the request id
-	Code  int         `json:"code"`  // response status code
-	Msg   string      `json:"msg"`   // response status message text
-	Data  interface{} `json:"data"`  // response data
-}
-
 // Send 往连接推送消息，线程安全
+// 消息放入连接的发送队列后即返回，由单独的 goroutine 写入连接
 func (c *Conn) Send(v ...*cs.Response) error {
-	if len(v) == 0 {
-		return nil
-	}
-	c.writeMu.Lock()
-	defer c.writeMu.Unlock()
 	for _, msg := range v {
-		resp := &responseData{
-			Cmd:   msg.Cmd,
-			Seqno: msg.Seqno,
-			Code:  msg.Code,
-			Msg:   msg.Msg,
-			Data:  msg.Data,
-		}
-
-		j, err := json.Marshal(resp)
-		if err != nil {
-			return err
-		}
-
-		if err := c.Conn.WriteMessage(c.msgType, json.RawMessage(j)); err != nil {
+		if err := c.queue.Push(msg); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// 把消息写入连接，由发送队列调用
+func (c *Conn) write(msg *cs.Response, deadline time.Time) error {
+	bt, err := c.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.Conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	return c.Conn.WriteMessage(c.msgType, bt)
+}
+
+// Codec 连接使用的消息编解码器
+func (c *Conn) Codec() cs.Codec {
+	return c.codec
+}
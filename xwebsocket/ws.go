@@ -1,10 +1,9 @@
 package xwebsocket
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"sync"
 	"sync/atomic"
@@ -15,15 +14,28 @@ import (
 )
 
 // WS websocket 适配器
+// 连接使用的消息编解码器通过 websocket 子协议协商，客户端请求的子协议中第一个已注册的编解码器名称会被使用，如 msgpack, cbor
+// 没有协商到时使用 Codec，使用非 JSON 编解码器时默认以二进制帧推送消息
+// 每个连接都有一个发送队列，队列的长度，满了之后的处理策略和写入超时通过 Queue 配置
 type WS struct {
 	Upgrader  websocket.Upgrader
+	Codec     cs.Codec       // 默认的消息编解码器
+	Queue     cs.QueueConfig // 连接发送队列的配置
+	Logger    cs.Logger      // 日志，为空时使用 Srv 的日志
+	srv       atomic.Value   // *cs.Srv
 	session   map[string]*Conn
 	sessionMu sync.RWMutex
 	receive   chan *reqMessage
 	sidCount  uint32
+	done      chan struct{} // 适配器关闭通知
+	closeOnce sync.Once
 }
 
 var _ cs.ServerAdapter = &WS{}
+var _ cs.ShutdownAdapter = &WS{}
+var _ cs.RemoteAddrAdapter = &WS{}
+var _ cs.CredentialsAdapter = &WS{}
+var _ cs.QueueAdapter = &WS{}
 
 // New 实例化 websocket 适配器
 func New() *WS {
@@ -32,8 +44,10 @@ func New() *WS {
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
 		},
+		Codec:   cs.JSONCodec,
 		session: make(map[string]*Conn),
 		receive: make(chan *reqMessage, 50),
+		done:    make(chan struct{}),
 	}
 }
 
@@ -44,8 +58,17 @@ func (ws *WS) Srv() *cs.Srv {
 
 // Handler impl http.HandlerFunc to upgrade to websocket protocol
 func (ws *WS) Handler(w http.ResponseWriter, req *http.Request) {
-	conn, err := ws.Upgrader.Upgrade(w, req, nil)
+	select {
+	case <-ws.done:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("websocket server is shutdown"))
+		return
+	default:
+	}
+	codec, header := ws.negotiateCodec(req)
+	conn, err := ws.Upgrader.Upgrade(w, req, header)
 	if err != nil {
+		ws.logger().Log(cs.LevelWarn, "websocket upgrade failed", "remote", req.RemoteAddr, "error", err)
 		return
 	}
 	atomic.AddUint32(&ws.sidCount, 1)
@@ -53,9 +76,12 @@ func (ws *WS) Handler(w http.ResponseWriter, req *http.Request) {
 	sid := fmt.Sprintf("ws.%d", ws.sidCount)
 
 	defer ws.destroyConn(sid)
-	ws.newConn(sid, conn)
-
-	fmt.Println("connection")
+	ws.logger().Log(cs.LevelDebug, "websocket connected", "sid", sid, "remote", req.RemoteAddr)
+	ws.newConn(sid, conn, codec, &cs.Credentials{
+		Header:     req.Header,
+		Query:      req.URL.Query(),
+		RemoteAddr: req.RemoteAddr,
+	})
 }
 
 // ServeHTTP impl http.Handler to upgrade to websocket protocol
@@ -64,12 +90,20 @@ func (ws *WS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 // Read 实现 cs.ServerAdapter 接口，读取消息，每次返回一条，循环读取
+// 适配器关闭后，会先读完已缓冲的消息再返回错误
 func (ws *WS) Read(s *cs.Srv) (string, *cs.Request, error) {
-	m, ok := <-ws.receive
-	if !ok {
-		return "", nil, errors.New("websocker server is shutdown")
+	ws.srv.Store(s)
+	select {
+	case m := <-ws.receive:
+		return m.sid, m.data, nil
+	case <-ws.done:
+		select {
+		case m := <-ws.receive:
+			return m.sid, m.data, nil
+		default:
+			return "", nil, errors.New("websocker server is shutdown")
+		}
 	}
-	return m.sid, m.data, nil
 }
 
 // Write 实现 cs.ServerAdapter 接口，给连接推送消息
@@ -88,6 +122,47 @@ func (ws *WS) Close(sid string) error {
 	return ws.destroyConn(sid)
 }
 
+// Shutdown 实现 cs.ShutdownAdapter 接口，拒绝新的连接并停止产生消息
+func (ws *WS) Shutdown(ctx context.Context) error {
+	ws.closeOnce.Do(func() {
+		close(ws.done)
+	})
+	return nil
+}
+
+// RemoteAddr 实现 cs.RemoteAddrAdapter 接口，获取连接的远程地址
+func (ws *WS) RemoteAddr(sid string) string {
+	ws.sessionMu.RLock()
+	conn, ok := ws.session[sid]
+	ws.sessionMu.RUnlock()
+	if !ok {
+		return ""
+	}
+	return conn.RemoteAddr().String()
+}
+
+// Credentials 实现 cs.CredentialsAdapter 接口，返回 websocket 升级请求的请求头和查询参数
+func (ws *WS) Credentials(sid string) *cs.Credentials {
+	ws.sessionMu.RLock()
+	conn, ok := ws.session[sid]
+	ws.sessionMu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return conn.cred
+}
+
+// QueueLen 实现 cs.QueueAdapter 接口，所有连接的发送队列中等待写入的消息数量
+func (ws *WS) QueueLen() int {
+	n := 0
+	ws.sessionMu.RLock()
+	for _, conn := range ws.session {
+		n += conn.queue.Len()
+	}
+	ws.sessionMu.RUnlock()
+	return n
+}
+
 // GetAllSID 实现 cs.ServerAdapter 接口，获取当前服务所有SID，用于遍历连接
 func (ws *WS) GetAllSID() []string {
 	sids := make([]string, 0, len(ws.session))
@@ -99,22 +174,52 @@ func (ws *WS) GetAllSID() []string {
 	return sids
 }
 
+// 根据 websocket 子协议协商消息编解码器，返回编解码器和升级协议的响应头
+func (ws *WS) negotiateCodec(req *http.Request) (cs.Codec, http.Header) {
+	if len(ws.Upgrader.Subprotocols) == 0 {
+		for _, protocol := range websocket.Subprotocols(req) {
+			if codec := cs.GetCodec(protocol); codec != nil {
+				return codec, http.Header{"Sec-Websocket-Protocol": {protocol}}
+			}
+		}
+	}
+	if ws.Codec == nil {
+		return cs.JSONCodec, nil
+	}
+	return ws.Codec, nil
+}
+
 // 初始化 ws 连接
-func (ws *WS) newConn(sid string, conn *websocket.Conn) {
+func (ws *WS) newConn(sid string, conn *websocket.Conn, codec cs.Codec, cred *cs.Credentials) {
+	msgType := websocket.TextMessage
+	if codec != cs.JSONCodec {
+		msgType = websocket.BinaryMessage
+	}
 	ws.sessionMu.Lock()
 	c := &Conn{
 		Conn:    conn,
-		msgType: websocket.TextMessage,
+		msgType: msgType,
+		codec:   codec,
+		cred:    cred,
 	}
+	c.queue = cs.NewOutboundQueue(ws.Queue, c.write, func(resp *cs.Response, err error) {
+		ws.writeError(sid, resp, err)
+	}, func() {
+		ws.destroyConn(sid)
+	})
 	ws.session[sid] = c
 	ws.sessionMu.Unlock()
-	ws.receive <- &reqMessage{msgType: websocket.TextMessage, data: &cs.Request{
+	ws.emit(&reqMessage{msgType: websocket.TextMessage, data: &cs.Request{
 		Cmd: cs.CmdConnected,
-	}, sid: sid}
+	}, sid: sid})
 	for {
 		messageType, payload, err := conn.ReadMessage()
 		if err != nil {
-			log.Println(err)
+			level := cs.LevelWarn
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				level = cs.LevelDebug
+			}
+			ws.logger().Log(level, "websocket read failed", "sid", sid, "error", err)
 			return
 		}
 		if c.msgType != messageType {
@@ -122,23 +227,31 @@ func (ws *WS) newConn(sid string, conn *websocket.Conn) {
 		}
 
 		if len(payload) == 0 { // heartbeat
-			ws.receive <- &reqMessage{msgType: messageType, data: &cs.Request{
+			ws.emit(&reqMessage{msgType: messageType, data: &cs.Request{
 				Cmd: cs.CmdHeartbeat,
-			}, sid: sid}
+			}, sid: sid})
 			continue
 		}
-		r := &requestData{}
-		if err = json.Unmarshal(payload, r); err != nil {
+		req := &cs.Request{}
+		if err = codec.Unmarshal(payload, req); err != nil {
+			ws.logger().Log(cs.LevelWarn, "decode message failed", "sid", sid, "codec", codec.Name(), "error", err)
 			continue
 		}
-		ws.receive <- &reqMessage{msgType: messageType, data: &cs.Request{
-			Cmd:     r.Cmd,
-			Seqno:   r.Seqno,
-			RawData: r.Data,
-		}, sid: sid}
+		ws.emit(&reqMessage{msgType: messageType, data: req, sid: sid})
 	}
 }
 
+// 日志，没有设置 Logger 时使用 Srv 的日志
+func (ws *WS) logger() cs.Logger {
+	if ws.Logger != nil {
+		return ws.Logger
+	}
+	if s, ok := ws.srv.Load().(*cs.Srv); ok {
+		return s.Logger()
+	}
+	return cs.NopLogger
+}
+
 // 销毁指定连接
 func (ws *WS) destroyConn(sid string) error {
 	ws.sessionMu.RLock()
@@ -147,15 +260,31 @@ func (ws *WS) destroyConn(sid string) error {
 	if !ok {
 		return errors.New("conn is already close")
 	}
+	conn.queue.Close()
 	err := conn.Close()
 	if err != nil {
 		return err
 	}
-	ws.receive <- &reqMessage{msgType: websocket.TextMessage, data: &cs.Request{
+	ws.emit(&reqMessage{msgType: websocket.TextMessage, data: &cs.Request{
 		Cmd: cs.CmdClosed,
-	}, sid: sid}
+	}, sid: sid})
 	ws.sessionMu.Lock()
 	delete(ws.session, sid)
 	ws.sessionMu.Unlock()
 	return nil
 }
+
+// 投递消息给 Read，适配器关闭后丢弃消息
+func (ws *WS) emit(m *reqMessage) {
+	select {
+	case ws.receive <- m:
+	case <-ws.done:
+	}
+}
+
+// 通知 Srv 推送消息的结果，err 为 nil 表示写入成功
+func (ws *WS) writeError(sid string, resp *cs.Response, err error) {
+	if s, ok := ws.srv.Load().(*cs.Srv); ok {
+		s.WriteError(sid, resp, err)
+	}
+}
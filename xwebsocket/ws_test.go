@@ -149,3 +149,33 @@ func ExampleNew() {
 
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
+
+func TestWSCodec(t *testing.T) {
+	ws := xwebsocket.New()
+	http.Handle("/ws-codec", ws)
+	srv := ws.Srv()
+	srv.Handle("echo", func(c *cs.Context) {
+		c.OK(c.RawData)
+	})
+	go srv.Run()
+
+	gtest.C(t, func(t *gtest.T) {
+		dialer := &websocket.Dialer{Subprotocols: []string{"unknown", "msgpack"}}
+		c, _, err := dialer.Dial("ws://127.0.0.1:5679/ws-codec", nil)
+		t.Assert(err, nil)
+		defer c.Close()
+		t.Assert(c.Subprotocol(), "msgpack")
+
+		err = c.WriteMessage(websocket.BinaryMessage, []byte("\x83\xa3cmd\xa4echo\xa5seqno\xa11\xa4data\x81\xa1x\x01"))
+		t.Assert(err, nil)
+		msgType, data, err := c.ReadMessage()
+		t.Assert(err, nil)
+		t.Assert(msgType, websocket.BinaryMessage)
+
+		res := &cs.Request{}
+		t.Assert(cs.MsgpackCodec.Unmarshal(data, res), nil)
+		t.Assert(res.Cmd, "echo")
+		t.Assert(res.Seqno, "1")
+		t.Assert(string(res.RawData), `{"x":1}`)
+	})
+}